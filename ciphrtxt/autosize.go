@@ -0,0 +1,184 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"fmt"
+)
+
+// Automatic sizing picks the target ring so that the messages expected in
+// the sector fit the store capacity, and places the sector on the bins which
+// are least replicated by peers (from their status advertisements).
+
+// the target sector is sized to fill at most this much of capacity (percent)
+// and is only widened if the wider sector would fill at most autoSizeGrowFill
+const autoSizeFill = 80
+const autoSizeGrowFill = 60
+
+// binUsage estimates the bytes stored per bin for full coverage from the
+// message sizes in the local header cache, which holds every header
+func (ms *MessageStore) binUsage() (perBin int64, err error) {
+	it := ms.LHC.IterSince(0, 0)
+	defer it.Close()
+	total := int64(0)
+	for it.Next() {
+		h := it.Header()
+		total += int64(h.BlockLen())*MessageHeaderLengthB64V2 + int64(len(h.Serialize()))
+	}
+	if err = it.Err(); err != nil {
+		return 0, err
+	}
+	return total / ShardNBins, nil
+}
+
+// targetUsage returns the bytes used by messages inside the targets.
+// Messages outside them are left to expire or contraction.
+func (ms *MessageStore) targetUsage() (used int64, err error) {
+	targets := ms.GetCurrentTargets()
+	iter := ms.db.iterAll()
+	defer iter.Release()
+	for iter.Next() {
+		m := new(MessageFile)
+		if m.Deserialize(iter.Value()) == nil {
+			continue
+		}
+		if targets.Contains(m.I) {
+			used += m.fileSize()
+		}
+	}
+	return used, iter.Error()
+}
+
+// peerReplication counts the peers advertising each bin (indexed from
+// ShardBaseVal)
+func (ms *MessageStore) peerReplication() (rep []int) {
+	rep = make([]int, ShardNBins)
+	for _, p := range ms.LHC.Peers {
+		for _, bin := range p.HC.status.SectorSet().Bins() {
+			rep[bin-ShardBaseVal] += 1
+		}
+	}
+	return rep
+}
+
+// autoRing returns the ring to target, starting from ring: outward while
+// the sector doesn't fit and inward while a wider sector fits with room
+func autoRing(ring uint, perBin int64, capacity int64) uint {
+	fits := func(r uint, fill int64) bool {
+		return int64(ShardNBins>>r)*perBin <= (capacity/100)*fill
+	}
+	if ring > ShardSectorOuterRing {
+		ring = ShardSectorOuterRing
+	}
+	for (ring < ShardSectorOuterRing) && !fits(ring, autoSizeFill) {
+		ring += 1
+	}
+	for (ring > 0) && fits(ring-1, autoSizeGrowFill) {
+		ring -= 1
+	}
+	return ring
+}
+
+// autoStart returns the start of the sector of size bins with the least
+// peer replication. Sectors at least as well placed as the current start
+// (within one replica per bin) keep it, otherwise ties are broken by
+// distance from current.
+func autoStart(rep []int, size int, current int) int {
+	sum := func(start int) (s int) {
+		for i := 0; i < size; i++ {
+			s += rep[(start-ShardBaseVal+i)%ShardNBins]
+		}
+		return s
+	}
+	distance := func(start int) int {
+		d := shardBin(start-current) - ShardBaseVal
+		if d > ShardNBins/2 {
+			d = ShardNBins - d
+		}
+		return d
+	}
+
+	best := current
+	bestSum := sum(current)
+	for start := ShardBaseVal; start < ShardMaxVal; start++ {
+		s := sum(start)
+		if (s < bestSum) || ((s == bestSum) && (distance(start) < distance(best))) {
+			best = start
+			bestSum = s
+		}
+	}
+	if sum(current)-bestSum < size {
+		return current
+	}
+	return best
+}
+
+// AutoTarget returns the sector the store should target for its capacity,
+// usage and the current peer coverage, starting from the current target
+func (ms *MessageStore) AutoTarget() (target ShardSector, err error) {
+	perBin, err := ms.binUsage()
+	if err != nil {
+		return target, err
+	}
+	ms.usedMutex.Lock()
+	capacity := ms.capacity
+	ms.usedMutex.Unlock()
+
+	current := ms.GetCurrentTarget()
+	if !current.Valid() {
+		current = ShardSector{Start: ShardBaseVal, Ring: ShardSectorOuterRing}
+	}
+	target.Ring = autoRing(current.Ring, perBin, capacity)
+
+	// the estimate is low if the target is over budget anyway, so step
+	// outward
+	used, err := ms.targetUsage()
+	if err != nil {
+		return target, err
+	}
+	if (used > (capacity/100)*autoSizeFill) && (target.Ring <= current.Ring) && (current.Ring < ShardSectorOuterRing) {
+		target.Ring = current.Ring + 1
+	}
+	target.Start = autoStart(ms.peerReplication(), target.Size(), current.Start)
+	return target, nil
+}
+
+// AutoSize retargets the store (see AutoTarget) if the target has changed
+func (ms *MessageStore) AutoSize() (changed bool, err error) {
+	target, err := ms.AutoTarget()
+	if err != nil {
+		return false, err
+	}
+	targets := ms.GetCurrentTargets()
+	if (len(targets) == 1) && (targets[0] == target) {
+		return false, nil
+	}
+	fmt.Printf("MS: auto sizing target %s -> %s\n", targets, target)
+	ms.SetTarget(target)
+	return true, nil
+}
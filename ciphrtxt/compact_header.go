@@ -0,0 +1,260 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// CompactMessageHeader holds a message header as a value in its binary form.
+// The array has the V2 layout (short header, r, s, nonce) for all versions;
+// V1 headers are stored with version 1 and zero blocklen, reserved and nonce
+// and the V3 extension block (if any) is held separately. Unlike
+// RawMessageHeader it can be copied and swapped without allocation, so it is
+// used for the header lists returned by the caches.
+type CompactMessageHeader struct {
+	b   [MessageHeaderLengthV2]byte
+	ext []byte
+}
+
+type CompactMessageHeaderSlice []CompactMessageHeader
+
+var compactVersionV1 = []byte("M\x01\x00\x00")
+var compactVersionV2 = []byte("M\x02\x00\x00")
+
+// Compact returns a compact copy of the header
+func (z *RawMessageHeader) Compact() (c CompactMessageHeader) {
+	c.setRaw(z)
+	return c
+}
+
+func (z *CompactMessageHeader) setRaw(h *RawMessageHeader) {
+	switch h.version {
+	case "0100":
+		copy(z.b[0:4], compactVersionV1)
+	case "0300":
+		copy(z.b[0:4], "M\x03\x00\x00")
+	default:
+		copy(z.b[0:4], compactVersionV2)
+	}
+	binary.BigEndian.PutUint32(z.b[4:8], h.time)
+	binary.BigEndian.PutUint32(z.b[8:12], h.expire)
+	copy(z.b[12:45], h.I)
+	copy(z.b[45:78], h.J)
+	copy(z.b[78:111], h.K)
+	binary.BigEndian.PutUint32(z.b[111:115], h.blocklen)
+	binary.BigEndian.PutUint64(z.b[115:123], h.reserved)
+	copy(z.b[123:155], h.r)
+	copy(z.b[155:187], h.s)
+	z.b[187] = byte(h.nonce >> 32)
+	binary.BigEndian.PutUint32(z.b[188:192], uint32(h.nonce))
+	z.ext = nil
+	if h.isV3() {
+		z.ext = make([]byte, len(h.ext))
+		copy(z.ext, h.ext)
+	}
+}
+
+// Raw returns the header as a RawMessageHeader
+func (z *CompactMessageHeader) Raw() (h *RawMessageHeader) {
+	h = new(RawMessageHeader)
+	switch z.b[1] {
+	case 1:
+		h.version = "0100"
+	case 3:
+		h.version = "0300"
+	default:
+		h.version = "0200"
+	}
+	h.time = z.time()
+	h.expire = z.expire()
+	h.I = append([]byte{}, z.IKey()...)
+	h.J = append([]byte{}, z.JKey()...)
+	h.K = append([]byte{}, z.KKey()...)
+	h.blocklen = z.BlockLen()
+	h.reserved = binary.BigEndian.Uint64(z.b[115:123])
+	h.r = append([]byte{}, z.b[123:155]...)
+	h.s = append([]byte{}, z.b[155:187]...)
+	h.nonce = z.Nonce()
+	if h.isV3() {
+		h.ext = append([]byte{}, z.ext...)
+	}
+	return h
+}
+
+func (z *CompactMessageHeader) time() uint32 {
+	return binary.BigEndian.Uint32(z.b[4:8])
+}
+
+func (z *CompactMessageHeader) expire() uint32 {
+	return binary.BigEndian.Uint32(z.b[8:12])
+}
+
+func (z *CompactMessageHeader) MessageTime() time.Time {
+	return time.Unix(int64(z.time()), 0)
+}
+
+func (z *CompactMessageHeader) ExpireTime() time.Time {
+	return time.Unix(int64(z.expire()), 0)
+}
+
+// IKey, JKey and KKey return slices of the header itself, which must not be
+// modified
+func (z *CompactMessageHeader) IKey() []byte {
+	return z.b[12:45:45]
+}
+
+func (z *CompactMessageHeader) JKey() []byte {
+	return z.b[45:78:78]
+}
+
+func (z *CompactMessageHeader) KKey() []byte {
+	return z.b[78:111:111]
+}
+
+func (z *CompactMessageHeader) BlockLen() uint32 {
+	return binary.BigEndian.Uint32(z.b[111:115])
+}
+
+func (z *CompactMessageHeader) Nonce() uint64 {
+	return (uint64(z.b[187]) << 32) | uint64(binary.BigEndian.Uint32(z.b[188:192]))
+}
+
+func (z *CompactMessageHeader) Extensions() ([]HeaderExtension, error) {
+	return parseExtensions(z.ext)
+}
+
+func (z *CompactMessageHeader) isV1() bool {
+	return z.b[1] == 1
+}
+
+func (z *CompactMessageHeader) isV2() bool {
+	return bytes.Equal(z.b[0:4], compactVersionV2)
+}
+
+func (z *CompactMessageHeader) Serialize() string {
+	if z.isV2() {
+		return base64.StdEncoding.EncodeToString(z.b[:])
+	}
+	return z.Raw().Serialize()
+}
+
+func (z *CompactMessageHeader) ExportBytes() []byte {
+	if z.isV2() {
+		b := make([]byte, MessageHeaderLengthV2)
+		copy(b, z.b[:])
+		return b
+	}
+	return z.Raw().ExportBytes()
+}
+
+func (z *CompactMessageHeader) Deserialize(s string) error {
+	// V2 headers are decoded directly into the array
+	if (len(s) >= MessageHeaderLengthB64V2) && (s[:4] == "TQIA") {
+		_, err := base64.StdEncoding.Decode(z.b[:], []byte(s[:MessageHeaderLengthB64V2]))
+		if err == nil && z.isV2() {
+			z.ext = nil
+			return nil
+		}
+	}
+	h := new(RawMessageHeader)
+	err := h.Deserialize(s)
+	if err != nil {
+		return err
+	}
+	z.setRaw(h)
+	return nil
+}
+
+// DeserializeStrict parses s with the checks of
+// RawMessageHeader.DeserializeStrict
+func (z *CompactMessageHeader) DeserializeStrict(s string) error {
+	h := new(RawMessageHeader)
+	err := h.DeserializeStrict(s)
+	if err != nil {
+		return err
+	}
+	z.setRaw(h)
+	return nil
+}
+
+func (z *CompactMessageHeader) ImportBytes(b []byte) error {
+	if (len(b) >= MessageHeaderLengthV2) && bytes.Equal(b[0:4], compactVersionV2) {
+		copy(z.b[:], b[:MessageHeaderLengthV2])
+		z.ext = nil
+		return nil
+	}
+	h := new(RawMessageHeader)
+	err := h.ImportBytes(b)
+	if err != nil {
+		return err
+	}
+	z.setRaw(h)
+	return nil
+}
+
+func (z *CompactMessageHeader) Hash() []byte {
+	hashval := sha256.Sum256([]byte(z.Serialize()))
+	return hashval[:]
+}
+
+func (z *CompactMessageHeader) Verify(body io.Reader) error {
+	return z.Raw().Verify(body)
+}
+
+func (z *CompactMessageHeader) JSON() *MessageHeaderJSON {
+	return z.Raw().JSON()
+}
+
+func (z *CompactMessageHeader) dbKeys(servertime uint32) (dbk *dbkeys, err error) {
+	return newDBKeys(z.time(), z.expire(), servertime, z.IKey(), z.JKey(), z.KKey()), nil
+}
+
+// Len, Less, Swap used for sorting slices of compact headers
+
+func (z CompactMessageHeaderSlice) Len() int {
+	return len(z)
+}
+
+func (z CompactMessageHeaderSlice) Less(i, j int) bool {
+	ti := z[i].time()
+	tj := z[j].time()
+	if ti != tj {
+		return ti < tj
+	}
+	return bytes.Compare(z[i].b[12:45], z[j].b[12:45]) < 0
+}
+
+func (z CompactMessageHeaderSlice) Swap(i, j int) {
+	z[i], z[j] = z[j], z[i]
+}
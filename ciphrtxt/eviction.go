@@ -0,0 +1,112 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+// EvictionPolicy orders stored messages for eviction when the message store
+// nears capacity. Messages are evicted in ascending order.
+type EvictionPolicy interface {
+	// Less returns true if a should be evicted before b. target is the
+	// set of sectors the store is currently trying to hold.
+	Less(a *MessageFile, b *MessageFile, target ShardSectorSet) bool
+	Name() string
+}
+
+// SoonestExpiringEviction evicts the messages which expire soonest first
+type SoonestExpiringEviction struct{}
+
+func (p *SoonestExpiringEviction) Less(a *MessageFile, b *MessageFile, target ShardSectorSet) bool {
+	if a.expire != b.expire {
+		return a.expire < b.expire
+	}
+	return a.fileSize() > b.fileSize()
+}
+
+func (p *SoonestExpiringEviction) Name() string {
+	return "expiring"
+}
+
+// LargestEviction evicts the largest messages first
+type LargestEviction struct{}
+
+func (p *LargestEviction) Less(a *MessageFile, b *MessageFile, target ShardSectorSet) bool {
+	sa := a.fileSize()
+	sb := b.fileSize()
+	if sa != sb {
+		return sa > sb
+	}
+	return a.expire < b.expire
+}
+
+func (p *LargestEviction) Name() string {
+	return "largest"
+}
+
+// OutsideTargetEviction evicts messages outside the target sectors first,
+// then orders by Then (soonest expiring if nil)
+type OutsideTargetEviction struct {
+	Then EvictionPolicy
+}
+
+func (p *OutsideTargetEviction) Less(a *MessageFile, b *MessageFile, target ShardSectorSet) bool {
+	ina := target.Contains(a.I)
+	inb := target.Contains(b.I)
+	if ina != inb {
+		return inb
+	}
+	then := p.Then
+	if then == nil {
+		then = &SoonestExpiringEviction{}
+	}
+	return then.Less(a, b, target)
+}
+
+func (p *OutsideTargetEviction) Name() string {
+	return "outside"
+}
+
+// DefaultEvictionPolicy drops messages outside the target sectors first
+var DefaultEvictionPolicy EvictionPolicy = &OutsideTargetEviction{}
+
+// evictionSlice sorts messages for eviction
+type evictionSlice struct {
+	msgs   []*MessageFile
+	policy EvictionPolicy
+	target ShardSectorSet
+}
+
+func (z evictionSlice) Len() int {
+	return len(z.msgs)
+}
+
+func (z evictionSlice) Less(i, j int) bool {
+	return z.policy.Less(z.msgs[i], z.msgs[j], z.target)
+}
+
+func (z evictionSlice) Swap(i, j int) {
+	z.msgs[i], z.msgs[j] = z.msgs[j], z.msgs[i]
+}
@@ -36,10 +36,13 @@ import (
 	//"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jadeblaquiere/cttd/btcec"
 )
 
 type MessageHeader interface {
@@ -53,6 +56,9 @@ type MessageHeader interface {
 	JKey() []byte
 	KKey() []byte
 	Hash() []byte
+	BlockLen() uint32
+	Extensions() ([]HeaderExtension, error)
+	isV1() bool
 	dbKeys(uint32) (*dbkeys, error)
 }
 
@@ -84,6 +90,50 @@ type SerializedMessageHeaderV1 [MessageHeaderLengthV1]byte
 // the encrypted message is signed along with the short header and then the
 // nonce is calculated to ensure the hash of the long header has nbits zeros
 // (see also Authenticated Encryption with Additional Data, AEAD, and Hashcash)
+//
+// The signature (r, s) is ECDSA (secp256k1) over SHA256(short || body), where
+// short is the 123 byte binary short header and body is the message body as
+// stored (i.e. everything in the message file following the 256 byte base64
+// header). The signature is verified with K as the public key.
+//
+// This signature scheme has not been checked against messages from the
+// reference client, so a message failing it is not rejected unless the
+// store requires signatures (see MessageStore.SetRequireSignatures).
+
+// V3 message header format:
+// "M\0x03\0x00\0x00" =>  4 bytes => Message File, v 3.00 / 0300
+// Message Time ... blocklength (as V2)
+// reserved           =>  8 bytes => 16-bit extension length (L), 48 bits
+//                                   reserved (should be zero)
+// extensions         =>  L bytes => TLV extension block (see HeaderExtension)
+// padding            =>  zero bytes to a multiple of 192 bytes overall
+// r, s, nonce        => 69 bytes => (as V2)
+//                      192 * n bytes (256 * n bytes in base64)
+// The V3 header occupies n blocks of the message file, so the file size is
+// (blocklen + n) * 256. The signature covers everything preceding r (short
+// header, extensions and padding) followed by the body.
+
+// HeaderExtension is a single TLV entry from the V3 extension block, encoded
+// as 1 byte type, 1 byte length, value. Type 0 is invalid.
+type HeaderExtension struct {
+	Type  uint8
+	Value []byte
+}
+
+// known extension types
+const (
+	HeaderExtContentClass  uint8 = 0x01
+	HeaderExtProtocolFlags uint8 = 0x02
+	HeaderExtPoWAlgorithm  uint8 = 0x03
+)
+
+// MaxHeaderExtensionLength is the maximum length of the encoded V3 extension
+// block (16-bit length in the reserved field)
+const MaxHeaderExtensionLength = 0xFFFF
+
+const signatureNonceLengthV2 = (32 + 32 + 5)
+
+const reservedMaskV3 = uint64(0x0000FFFFFFFFFFFF)
 
 //const ShortMessageHeaderLengthV2 = (4+4+4+33+33+33+4+8)
 const ShortMessageHeaderLengthV2 = (123)
@@ -104,18 +154,24 @@ type BinaryMessageHeaderV2 [MessageHeaderLengthV2]byte
 // instead of parsing them to their numerical value
 
 type MessageHeaderJSON struct {
-	Version   string `json:"version"`
-	Time      uint32 `json:"time"`
-	Expire    uint32 `json:"expire"`
-	TimeStr   string `json:"time_str"`
-	ExpireStr string `json:"expire_str"`
-	I         string `json:"I"`
-	J         string `json:"J"`
-	K         string `json:"K"`
-	Size      uint64 `json:"Size"`
-	R         string `json:"sig_r"`
-	S         string `json:"sig_s"`
-	Nonce     uint64 `json:"nonce"`
+	Version    string                `json:"version"`
+	Time       uint32                `json:"time"`
+	Expire     uint32                `json:"expire"`
+	TimeStr    string                `json:"time_str"`
+	ExpireStr  string                `json:"expire_str"`
+	I          string                `json:"I"`
+	J          string                `json:"J"`
+	K          string                `json:"K"`
+	Size       uint64                `json:"Size"`
+	R          string                `json:"sig_r"`
+	S          string                `json:"sig_s"`
+	Nonce      uint64                `json:"nonce"`
+	Extensions []HeaderExtensionJSON `json:"extensions,omitempty"`
+}
+
+type HeaderExtensionJSON struct {
+	Type  uint8  `json:"type"`
+	Value string `json:"value"`
 }
 
 type RawMessageHeader struct {
@@ -127,6 +183,7 @@ type RawMessageHeader struct {
 	K        []byte
 	blocklen uint32
 	reserved uint64
+	ext      []byte
 	r        []byte
 	s        []byte
 	nonce    uint64
@@ -134,37 +191,66 @@ type RawMessageHeader struct {
 
 type RawMessageHeaderSlice []RawMessageHeader
 
+// SignatureError is returned when a message header signature cannot be
+// validated against the message body
+type SignatureError struct {
+	I      []byte
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("message %s signature invalid: %s", hex.EncodeToString(e.I), e.Reason)
+}
+
+// HeaderFieldError is returned when a message header cannot be parsed or
+// fails validation. Field names the offending header field.
+type HeaderFieldError struct {
+	Version string
+	Field   string
+	Reason  string
+}
+
+func (e *HeaderFieldError) Error() string {
+	return fmt.Sprintf("%s header field %s: %s", e.Version, e.Field, e.Reason)
+}
+
 func (z *RawMessageHeader) deserializeV1(s string) error {
 	var err error
 	var t64 uint64
 	var d = strings.Split(s, ":")
 	if len(d) != 8 || strings.Compare(d[0], "M0100") != 0 {
-		return errors.New("V1 version string error")
+		return &HeaderFieldError{"V1", "version", "version string error"}
 	}
 	z.version = "0100"
-	t64, _ = strconv.ParseUint(d[1], 16, 32)
+	t64, err = strconv.ParseUint(d[1], 16, 32)
+	if err != nil {
+		return &HeaderFieldError{"V1", "time", "error decoding value as hex"}
+	}
 	z.time = uint32(t64)
-	t64, _ = strconv.ParseUint(d[2], 16, 32)
+	t64, err = strconv.ParseUint(d[2], 16, 32)
+	if err != nil {
+		return &HeaderFieldError{"V1", "expire", "error decoding value as hex"}
+	}
 	z.expire = uint32(t64)
 	z.I, err = hex.DecodeString(d[3])
 	if err != nil {
-		return errors.New("V1 Error decoding I value as hex")
+		return &HeaderFieldError{"V1", "I", "error decoding value as hex"}
 	}
 	z.J, err = hex.DecodeString(d[4])
 	if err != nil {
-		return errors.New("V1 Error decoding J value as hex")
+		return &HeaderFieldError{"V1", "J", "error decoding value as hex"}
 	}
 	z.K, err = hex.DecodeString(d[5])
 	if err != nil {
-		return errors.New("V1 Error decoding K value as hex")
+		return &HeaderFieldError{"V1", "K", "error decoding value as hex"}
 	}
 	z.r, err = hex.DecodeString(d[6])
 	if err != nil {
-		return errors.New("V1 Error decoding r value as hex")
+		return &HeaderFieldError{"V1", "r", "error decoding value as hex"}
 	}
 	z.s, err = hex.DecodeString(d[7])
 	if err != nil {
-		return errors.New("V1 Error decoding s value as hex")
+		return &HeaderFieldError{"V1", "s", "error decoding value as hex"}
 	}
 	return nil
 }
@@ -174,7 +260,10 @@ func (z *RawMessageHeader) deserializeV2(s string) error {
 	smh := make([]byte, 0)
 	if len(s) < ShortMessageHeaderLengthB64V2 {
 		//fmt.Println("message too short")
-		return errors.New("V2 Header too short")
+		return &HeaderFieldError{"V2", "header", "header too short"}
+	}
+	if strings.HasPrefix(s, "TQMA") {
+		return z.deserializeV3(s)
 	}
 	if len(s) >= MessageHeaderLengthB64V2 {
 		smh, err = base64.StdEncoding.DecodeString(s[:MessageHeaderLengthB64V2])
@@ -183,20 +272,104 @@ func (z *RawMessageHeader) deserializeV2(s string) error {
 	}
 	if err != nil {
 		//fmt.Println("base64 conversion failed")
-		return errors.New("V2 not in base64")
+		return &HeaderFieldError{"V2", "header", "not in base64"}
 	}
 	return z.importBinaryHeaderV2(smh[:])
 }
 
+// deserializeV3 decodes the short header to determine the extension length
+// and then the complete (multiple block) header
+func (z *RawMessageHeader) deserializeV3(s string) error {
+	b64len, err := serializedLengthV3(s)
+	if err != nil {
+		return err
+	}
+	if len(s) < b64len {
+		return &HeaderFieldError{"V3", "header", "header too short"}
+	}
+	smh, err := base64.StdEncoding.DecodeString(s[:b64len])
+	if err != nil {
+		return &HeaderFieldError{"V3", "header", "not in base64"}
+	}
+	return z.importBinaryHeaderV3(smh)
+}
+
+// serializedLengthV3 returns the length of the serialized V3 header starting
+// with s, which must include at least the (base64) short header
+func serializedLengthV3(s string) (int, error) {
+	if len(s) < ShortMessageHeaderLengthB64V2 {
+		return 0, &HeaderFieldError{"V3", "header", "header too short"}
+	}
+	short, err := base64.StdEncoding.DecodeString(s[:ShortMessageHeaderLengthB64V2])
+	if err != nil {
+		return 0, &HeaderFieldError{"V3", "header", "not in base64"}
+	}
+	extlen := int(binary.BigEndian.Uint64(short[115:123]) >> 48)
+	return (headerLengthV3(extlen) * 4) / 3, nil
+}
+
+// headerLengthV3 returns the binary length of a V3 header with an extension
+// block of extlen bytes
+func headerLengthV3(extlen int) int {
+	n := ShortMessageHeaderLengthV2 + extlen + signatureNonceLengthV2
+	return ((n + MessageHeaderLengthV2 - 1) / MessageHeaderLengthV2) * MessageHeaderLengthV2
+}
+
+// importBinaryHeader imports a V2 or V3 binary header
+func (z *RawMessageHeader) importBinaryHeader(smh []byte) error {
+	if (len(smh) >= 4) && (bytes.Compare(smh[:4], []byte("M\x03\x00\x00")) == 0) {
+		return z.importBinaryHeaderV3(smh)
+	}
+	return z.importBinaryHeaderV2(smh)
+}
+
+func (z *RawMessageHeader) importBinaryHeaderV3(smh []byte) error {
+	if len(smh) < ShortMessageHeaderLengthV2 {
+		return &HeaderFieldError{"V3", "header", "header too short"}
+	}
+	if bytes.Compare(smh[:4], []byte("M\x03\x00\x00")) != 0 {
+		return &HeaderFieldError{"V3", "version", "version string mismatch"}
+	}
+	z.importShortHeader(smh)
+	z.version = "0300"
+	extlen := int(z.reserved >> 48)
+	hlen := headerLengthV3(extlen)
+	if len(smh) < hlen {
+		return &HeaderFieldError{"V3", "header", "header too short"}
+	}
+	z.ext = make([]byte, extlen)
+	copy(z.ext, smh[ShortMessageHeaderLengthV2:ShortMessageHeaderLengthV2+extlen])
+	// padding must be zero for the header to serialize (and hash) identically
+	for _, b := range smh[ShortMessageHeaderLengthV2+extlen : hlen-signatureNonceLengthV2] {
+		if b != 0 {
+			return &HeaderFieldError{"V3", "extensions", "non-zero padding"}
+		}
+	}
+	z.importSignatureNonce(smh[hlen-signatureNonceLengthV2 : hlen])
+	return nil
+}
+
 func (z *RawMessageHeader) importBinaryHeaderV2(smh []byte) error {
 	if len(smh) < ShortMessageHeaderLengthV2 {
-		return errors.New("V2 Header too short")
+		return &HeaderFieldError{"V2", "header", "header too short"}
 	}
 	if bytes.Compare(smh[:4], []byte("M\x02\x00\x00")) != 0 {
 		//fmt.Println("v0200 version string mismatch")
-		return errors.New("V2 version string mismatch")
+		return &HeaderFieldError{"V2", "version", "version string mismatch"}
 	}
+	z.importShortHeader(smh)
 	z.version = "0200"
+	z.ext = nil
+	if len(smh) >= MessageHeaderLengthV2 {
+		z.importSignatureNonce(smh[ShortMessageHeaderLengthV2:MessageHeaderLengthV2])
+	}
+	//jsontxt, _ := json.Marshal(z.JSON())
+	//fmt.Printf("imported as (JSON) %s\n", jsontxt)
+	return nil
+}
+
+// importShortHeader imports the fields common to the V2 and V3 short header
+func (z *RawMessageHeader) importShortHeader(smh []byte) {
 	z.time = binary.BigEndian.Uint32(smh[4:8])
 	z.expire = binary.BigEndian.Uint32(smh[8:12])
 	//z.I = string(smh[12:45])
@@ -210,26 +383,28 @@ func (z *RawMessageHeader) importBinaryHeaderV2(smh []byte) error {
 	copy(z.K, smh[78:111])
 	z.blocklen = binary.BigEndian.Uint32(smh[111:115])
 	z.reserved = binary.BigEndian.Uint64(smh[115:123])
-	if len(smh) >= MessageHeaderLengthV2 {
-		var ui8 uint8
-		var ui32 uint32
-		z.r = make([]byte, 32)
-		copy(z.r, smh[123:155])
-		z.s = make([]byte, 32)
-		copy(z.s, smh[155:187])
-		bufnonce := bytes.NewBuffer(smh[187:188])
-		binary.Read(bufnonce, binary.BigEndian, &ui8)
-		bufnonce = bytes.NewBuffer(smh[188:192])
-		binary.Read(bufnonce, binary.BigEndian, &ui32)
-		z.nonce = ((uint64)(ui8) << 32)
-		z.nonce += (uint64)(ui32)
-	}
-	//jsontxt, _ := json.Marshal(z.JSON())
-	//fmt.Printf("imported as (JSON) %s\n", jsontxt)
-	return nil
+}
+
+// importSignatureNonce imports r, s and nonce from the last 69 header bytes
+func (z *RawMessageHeader) importSignatureNonce(smh []byte) {
+	var ui8 uint8
+	var ui32 uint32
+	z.r = make([]byte, 32)
+	copy(z.r, smh[0:32])
+	z.s = make([]byte, 32)
+	copy(z.s, smh[32:64])
+	bufnonce := bytes.NewBuffer(smh[64:65])
+	binary.Read(bufnonce, binary.BigEndian, &ui8)
+	bufnonce = bytes.NewBuffer(smh[65:69])
+	binary.Read(bufnonce, binary.BigEndian, &ui32)
+	z.nonce = ((uint64)(ui8) << 32)
+	z.nonce += (uint64)(ui32)
 }
 
 func (z *RawMessageHeader) Deserialize(s string) error {
+	if len(s) < 3 {
+		return &HeaderFieldError{"", "version", "header too short"}
+	}
 	if strings.Compare(s[:3], "M01") == 0 {
 		return z.deserializeV1(s)
 	} else {
@@ -238,12 +413,208 @@ func (z *RawMessageHeader) Deserialize(s string) error {
 }
 
 func (z *RawMessageHeader) ImportBytes(b []byte) error {
+	if len(b) < 3 {
+		return &HeaderFieldError{"", "version", "header too short"}
+	}
 	if bytes.Compare(b[:3], []byte("M01")) == 0 {
 		s := string(b)
 		return z.deserializeV1(s)
 	} else {
-		return z.importBinaryHeaderV2(b)
+		return z.importBinaryHeader(b)
+	}
+}
+
+// DeserializeStrict parses a serialized (V1 hex or V2/V3 base64) header like
+// Deserialize, but additionally requires the exact header length, valid
+// compressed curve points for I, J and K, full length signature values,
+// a zero reserved field (other than the V3 extension length) and a well
+// formed extension block. Errors are returned as *HeaderFieldError.
+func (z *RawMessageHeader) DeserializeStrict(s string) error {
+	if len(s) < 3 {
+		return &HeaderFieldError{"", "version", "header too short"}
+	}
+	if strings.Compare(s[:3], "M01") == 0 {
+		if len(s) != MessageHeaderLengthV1 {
+			return &HeaderFieldError{"V1", "header", fmt.Sprintf("length %d, expected %d", len(s), MessageHeaderLengthV1)}
+		}
+		err := z.deserializeV1(s)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := z.deserializeV2(s)
+		if err != nil {
+			return err
+		}
+		if len(s) != z.serializedLength() {
+			return &HeaderFieldError{z.versionName(), "header", fmt.Sprintf("length %d, expected %d", len(s), z.serializedLength())}
+		}
+	}
+	return z.validateStrict()
+}
+
+// ImportBytesStrict imports a binary (V2/V3) or V1 header with the same
+// checks as DeserializeStrict
+func (z *RawMessageHeader) ImportBytesStrict(b []byte) error {
+	if len(b) < 3 {
+		return &HeaderFieldError{"", "version", "header too short"}
+	}
+	if bytes.Compare(b[:3], []byte("M01")) == 0 {
+		return z.DeserializeStrict(string(b))
+	}
+	err := z.importBinaryHeader(b)
+	if err != nil {
+		return err
+	}
+	if len(b) != z.binaryLength() {
+		return &HeaderFieldError{z.versionName(), "header", fmt.Sprintf("length %d, expected %d", len(b), z.binaryLength())}
+	}
+	return z.validateStrict()
+}
+
+func validatePoint(version string, field string, pt []byte) error {
+	if len(pt) != 33 {
+		return &HeaderFieldError{version, field, fmt.Sprintf("point length %d, expected 33", len(pt))}
+	}
+	if (pt[0] != 0x02) && (pt[0] != 0x03) {
+		return &HeaderFieldError{version, field, fmt.Sprintf("invalid compressed point prefix 0x%02x", pt[0])}
+	}
+	curve := btcec.S256()
+	if new(big.Int).SetBytes(pt[1:]).Cmp(curve.Params().P) >= 0 {
+		return &HeaderFieldError{version, field, "point x coordinate out of range"}
+	}
+	_, err := btcec.ParsePubKey(pt, curve)
+	if err != nil {
+		return &HeaderFieldError{version, field, "point not on curve"}
+	}
+	return nil
+}
+
+func (z *RawMessageHeader) validateStrict() error {
+	v := z.versionName()
+	err := validatePoint(v, "I", z.I)
+	if err != nil {
+		return err
+	}
+	err = validatePoint(v, "J", z.J)
+	if err != nil {
+		return err
+	}
+	err = validatePoint(v, "K", z.K)
+	if err != nil {
+		return err
+	}
+	if len(z.r) != 32 {
+		return &HeaderFieldError{v, "r", fmt.Sprintf("length %d, expected 32", len(z.r))}
+	}
+	if len(z.s) != 32 {
+		return &HeaderFieldError{v, "s", fmt.Sprintf("length %d, expected 32", len(z.s))}
+	}
+	if z.isV3() {
+		if (z.reserved & reservedMaskV3) != 0 {
+			return &HeaderFieldError{v, "reserved", "reserved field must be zero"}
+		}
+		_, err = z.Extensions()
+		return err
+	}
+	if z.reserved != 0 {
+		return &HeaderFieldError{v, "reserved", "reserved field must be zero"}
+	}
+	return nil
+}
+
+func (z *RawMessageHeader) versionName() string {
+	switch z.version {
+	case "0100":
+		return "V1"
+	case "0300":
+		return "V3"
+	default:
+		return "V2"
+	}
+}
+
+// binaryLength returns the length of the binary (V2/V3) header
+func (z *RawMessageHeader) binaryLength() int {
+	if z.isV3() {
+		return headerLengthV3(len(z.ext))
+	}
+	return MessageHeaderLengthV2
+}
+
+// serializedLength returns the length of the serialized header, which for
+// V2/V3 is also the offset of the message body in the message file
+func (z *RawMessageHeader) serializedLength() int {
+	if z.isV1() {
+		return MessageHeaderLengthV1
+	}
+	return (z.binaryLength() * 4) / 3
+}
+
+// Extensions parses the V3 extension block. V1 and V2 headers have no
+// extensions.
+func (z *RawMessageHeader) Extensions() (ext []HeaderExtension, err error) {
+	return parseExtensions(z.ext)
+}
+
+func parseExtensions(b []byte) (ext []HeaderExtension, err error) {
+	ext = make([]HeaderExtension, 0)
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, &HeaderFieldError{"V3", "extensions", "truncated extension"}
+		}
+		if b[0] == 0 {
+			return nil, &HeaderFieldError{"V3", "extensions", "invalid extension type 0"}
+		}
+		vlen := int(b[1])
+		if len(b) < (2 + vlen) {
+			return nil, &HeaderFieldError{"V3", "extensions", fmt.Sprintf("extension type %d truncated", b[0])}
+		}
+		value := make([]byte, vlen)
+		copy(value, b[2:2+vlen])
+		ext = append(ext, HeaderExtension{Type: b[0], Value: value})
+		b = b[2+vlen:]
 	}
+	return ext, nil
+}
+
+// Extension returns the value of the first extension of type t
+func (z *RawMessageHeader) Extension(t uint8) (value []byte, ok bool) {
+	ext, err := z.Extensions()
+	if err != nil {
+		return nil, false
+	}
+	for _, e := range ext {
+		if e.Type == t {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetExtensions encodes ext as the extension block and converts the header
+// to V3. As the extensions are covered by the signature and the header hash
+// this must be done before the header is signed and mined.
+func (z *RawMessageHeader) SetExtensions(ext []HeaderExtension) error {
+	buf := new(bytes.Buffer)
+	for _, e := range ext {
+		if e.Type == 0 {
+			return &HeaderFieldError{"V3", "extensions", "invalid extension type 0"}
+		}
+		if len(e.Value) > 0xFF {
+			return &HeaderFieldError{"V3", "extensions", fmt.Sprintf("extension type %d value too long", e.Type)}
+		}
+		buf.WriteByte(e.Type)
+		buf.WriteByte(uint8(len(e.Value)))
+		buf.Write(e.Value)
+	}
+	if buf.Len() > MaxHeaderExtensionLength {
+		return &HeaderFieldError{"V3", "extensions", "extension block too long"}
+	}
+	z.version = "0300"
+	z.ext = buf.Bytes()
+	z.reserved = (z.reserved & reservedMaskV3) | (uint64(len(z.ext)) << 48)
+	return nil
 }
 
 func (z *RawMessageHeader) serializeV1() *SerializedMessageHeaderV1 {
@@ -263,9 +634,14 @@ func (z *RawMessageHeader) serializeV1() *SerializedMessageHeaderV1 {
 	return smh
 }
 
-func (z *RawMessageHeader) exportBinaryHeaderV2() *BinaryMessageHeaderV2 {
+// exportBinaryHeader exports a V2 or V3 binary header
+func (z *RawMessageHeader) exportBinaryHeader() []byte {
 	buf := new(bytes.Buffer)
-	buf.WriteString("M\x02\x00\x00")
+	if z.isV3() {
+		buf.WriteString("M\x03\x00\x00")
+	} else {
+		buf.WriteString("M\x02\x00\x00")
+	}
 	binary.Write(buf, binary.BigEndian, z.time)
 	binary.Write(buf, binary.BigEndian, z.expire)
 	buf.Write(z.I)
@@ -273,17 +649,32 @@ func (z *RawMessageHeader) exportBinaryHeaderV2() *BinaryMessageHeaderV2 {
 	buf.Write(z.K)
 	binary.Write(buf, binary.BigEndian, z.blocklen)
 	binary.Write(buf, binary.BigEndian, z.reserved)
+	if z.isV3() {
+		buf.Write(z.ext)
+		buf.Write(make([]byte, z.binaryLength()-buf.Len()-signatureNonceLengthV2))
+	}
 	buf.Write(z.r)
 	buf.Write(z.s)
 	binary.Write(buf, binary.BigEndian, uint8(z.nonce>>32))
 	binary.Write(buf, binary.BigEndian, uint32(z.nonce&0xFFFFFFFF))
 	//fmt.Println("serialized as : " + hex.EncodeToString(buf.Bytes()))
-	if buf.Len() != MessageHeaderLengthV2 {
+	if buf.Len() != z.binaryLength() {
 		//fmt.Printf("Message length invalid: %d chars\n", buf.Len())
 		return nil
 	}
+	return buf.Bytes()
+}
+
+func (z *RawMessageHeader) exportBinaryHeaderV2() *BinaryMessageHeaderV2 {
+	if z.isV3() {
+		return nil
+	}
+	b := z.exportBinaryHeader()
+	if b == nil {
+		return nil
+	}
 	bmh := new(BinaryMessageHeaderV2)
-	copy(bmh[:], buf.Bytes()[:])
+	copy(bmh[:], b)
 	return bmh
 }
 
@@ -301,7 +692,7 @@ func (z *RawMessageHeader) Serialize() string {
 	if strings.Compare(z.version, "0100") == 0 {
 		return string(z.serializeV1()[:])
 	} else {
-		return string(z.serializeV2()[:])
+		return base64.StdEncoding.EncodeToString(z.exportBinaryHeader())
 	}
 }
 
@@ -314,7 +705,7 @@ func (z *RawMessageHeader) SerializeV1() *SerializedMessageHeaderV1 {
 }
 
 func (z *RawMessageHeader) SerializeV2() *SerializedMessageHeaderV2 {
-	if strings.Compare(z.version, "0100") == 0 {
+	if strings.Compare(z.version, "0200") != 0 {
 		return nil
 	} else {
 		return z.serializeV2()
@@ -322,7 +713,7 @@ func (z *RawMessageHeader) SerializeV2() *SerializedMessageHeaderV2 {
 }
 
 func (z *RawMessageHeader) ExportBinaryHeaderV2() *BinaryMessageHeaderV2 {
-	if strings.Compare(z.version, "0100") == 0 {
+	if strings.Compare(z.version, "0200") != 0 {
 		return nil
 	} else {
 		return z.exportBinaryHeaderV2()
@@ -341,7 +732,7 @@ func (z *RawMessageHeader) ExportBytes() []byte {
 	if strings.Compare(z.version, "0100") == 0 {
 		return []byte(string(z.SerializeV1()[:]))
 	} else {
-		return z.exportBinaryHeaderV2()[:]
+		return z.exportBinaryHeader()
 	}
 }
 
@@ -365,11 +756,65 @@ func (z *RawMessageHeader) KKey() (k []byte) {
 	return z.K
 }
 
+func (z *RawMessageHeader) BlockLen() uint32 {
+	return z.blocklen
+}
+
+func (z *RawMessageHeader) isV1() bool {
+	return strings.Compare(z.version, "0100") == 0
+}
+
+func (z *RawMessageHeader) isV3() bool {
+	return strings.Compare(z.version, "0300") == 0
+}
+
 func (z *RawMessageHeader) Hash() []byte {
 	hashval := sha256.Sum256([]byte(z.Serialize()))
 	return hashval[:]
 }
 
+func (z *RawMessageHeader) signatureHash(body io.Reader) (hash []byte, err error) {
+	bmh := z.exportBinaryHeader()
+	if bmh == nil {
+		return nil, errors.New("Header export failed")
+	}
+	h := sha256.New()
+	h.Write(bmh[:len(bmh)-signatureNonceLengthV2])
+	_, err = io.Copy(h, body)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Verify checks the header signature (r, s) against the short header and the
+// (encrypted) message body read from body, using K as the public key. If the
+// signature is not valid a *SignatureError is returned.
+func (z *RawMessageHeader) Verify(body io.Reader) (err error) {
+	if strings.Compare(z.version, "0100") == 0 {
+		return &SignatureError{I: z.I, Reason: "V1 message signatures not supported"}
+	}
+	if (len(z.r) != 32) || (len(z.s) != 32) {
+		return &SignatureError{I: z.I, Reason: "header does not include signature"}
+	}
+	K, err := btcec.ParsePubKey(z.K, btcec.S256())
+	if err != nil {
+		return &SignatureError{I: z.I, Reason: "K is not a valid public key"}
+	}
+	hash, err := z.signatureHash(body)
+	if err != nil {
+		return err
+	}
+	sig := btcec.Signature{
+		R: new(big.Int).SetBytes(z.r),
+		S: new(big.Int).SetBytes(z.s),
+	}
+	if !sig.Verify(hash, K) {
+		return &SignatureError{I: z.I, Reason: "signature does not match header and body"}
+	}
+	return nil
+}
+
 // Len, Less, Swap used for sorting slices of RMH
 
 func (z RawMessageHeaderSlice) Len() int {
@@ -395,10 +840,7 @@ func (z RawMessageHeaderSlice) Less(i, j int) bool {
 }
 
 func (z RawMessageHeaderSlice) Swap(i, j int) {
-	t1 := z[i].Serialize()
-	t2 := z[j].Serialize()
-	z[j].Deserialize(t1)
-	z[i].Deserialize(t2)
+	z[i], z[j] = z[j], z[i]
 }
 
 func (z *RawMessageHeader) JSON() *MessageHeaderJSON {
@@ -411,33 +853,40 @@ func (z *RawMessageHeader) JSON() *MessageHeaderJSON {
 	r.I = hex.EncodeToString(z.I)
 	r.J = hex.EncodeToString(z.J)
 	r.K = hex.EncodeToString(z.K)
-	r.Size = uint64(z.blocklen+1) * MessageHeaderLengthB64V2
+	r.Size = uint64(z.blocklen)*MessageHeaderLengthB64V2 + uint64(z.serializedLength())
 	r.R = hex.EncodeToString(z.r)
 	r.S = hex.EncodeToString(z.s)
 	r.Nonce = z.nonce
+	ext, _ := z.Extensions()
+	for _, e := range ext {
+		r.Extensions = append(r.Extensions, HeaderExtensionJSON{Type: e.Type, Value: hex.EncodeToString(e.Value)})
+	}
 
 	return r
 }
 
 func (h *RawMessageHeader) dbKeys(servertime uint32) (dbk *dbkeys, err error) {
-	dbk = new(dbkeys)
-	dbk.date, err = hex.DecodeString(fmt.Sprintf("D0%08X", h.time))
-	if err != nil {
-		return nil, err
-	}
-	dbk.date = append(dbk.date, h.I...)
-	dbk.servertime, err = hex.DecodeString(fmt.Sprintf("C0%08X", servertime))
-	if err != nil {
-		return nil, err
-	}
-	dbk.servertime = append(dbk.servertime, h.I...)
-	dbk.expire, err = hex.DecodeString(fmt.Sprintf("E0%08X", h.expire))
-	if err != nil {
-		return nil, err
+	return newDBKeys(h.time, h.expire, servertime, h.I, h.J, h.K), nil
+}
+
+// newDBKeys builds the database keys for a header: prefix byte (D0 = time,
+// C0 = servertime, E0 = expire) || 32 bit time || I, the recipient keys
+// (A0 || J || I and B0 || K || I) and I itself
+func newDBKeys(time, expire, servertime uint32, I, J, K []byte) (dbk *dbkeys) {
+	key := func(prefix byte, t uint32) []byte {
+		k := make([]byte, 5, 5+len(I))
+		k[0] = prefix
+		binary.BigEndian.PutUint32(k[1:5], t)
+		return append(k, I...)
 	}
-	dbk.expire = append(dbk.expire, h.I...)
-	dbk.I = h.I
-	return dbk, err
+	dbk = new(dbkeys)
+	dbk.date = key(indexPrefixDate, time)
+	dbk.servertime = key(indexPrefixServertime, servertime)
+	dbk.expire = key(indexPrefixExpire, expire)
+	dbk.I = I
+	dbk.J = append(append([]byte{indexPrefixJ}, J...), I...)
+	dbk.K = append(append([]byte{indexPrefixK}, K...), I...)
+	return dbk
 }
 
 type FullMessageHeader struct {
@@ -529,11 +978,28 @@ func (z *FullMessageHeader) KKey() []byte {
 	return padbytes(&z.K, 33)
 }
 
+func (z *FullMessageHeader) BlockLen() uint32 {
+	return z.rmh.BlockLen()
+}
+
+func (z *FullMessageHeader) Extensions() ([]HeaderExtension, error) {
+	return z.rmh.Extensions()
+}
+
+func (z *FullMessageHeader) isV1() bool {
+	return z.rmh.isV1()
+}
+
 func (z *FullMessageHeader) Hash() []byte {
 	hashval := sha256.Sum256([]byte(z.Serialize()))
 	return hashval[:]
 }
 
+func (z *FullMessageHeader) Verify(body io.Reader) (err error) {
+	z.ExportBytes()
+	return z.rmh.Verify(body)
+}
+
 func (z *FullMessageHeader) dbKeys(servertime uint32) (dbk *dbkeys, err error) {
 	z.rmh.I = padbytes(&z.I, 33)
 	return z.rmh.dbKeys(servertime)
@@ -34,8 +34,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -78,24 +76,47 @@ type StatusNetworkResponse struct {
 	TOKPort int    `json:"token_service_port"`
 }
 
+// StatusResponse describes a node to its peers. Sector is the first sector
+// stored, nodes storing more than one sector list them all in Sectors.
 type StatusResponse struct {
 	Network StatusNetworkResponse `json:"network"`
 	Pubkey  string                `json:"pubkey"`
+	PoW     PoWPolicyStatus       `json:"pow"`
 	Sector  ShardSector           `json:"sector"`
+	Sectors ShardSectorSet        `json:"sectors,omitempty"`
 	Storage StatusStorageResponse `json:"storage"`
 	Version string                `json:"version"`
 }
 
+// SectorSet returns the sectors advertised, which is empty for nodes that
+// do not store messages
+func (sr *StatusResponse) SectorSet() ShardSectorSet {
+	if len(sr.Sectors) > 0 {
+		return sr.Sectors.Union(nil)
+	}
+	if sr.Sector.Valid() {
+		return ShardSectorSet{sr.Sector}
+	}
+	return ShardSectorSet{}
+}
+
 type TimeResponse struct {
 	Time int `json:"time"`
 }
 
+// HeaderListResponse and MessageListResponse include a cursor to request
+// the remainder of the list if it was limited, or an error if the list is
+// incomplete because the server failed while sending it
 type HeaderListResponse struct {
 	Headers []string `json:"header_list"`
+	Cursor  string   `json:"cursor,omitempty"`
+	Error   string   `json:"error,omitempty"`
 }
 
 type MessageListResponse struct {
 	Messages []string `json:"message_list"`
+	Cursor   string   `json:"cursor,omitempty"`
+	Error    string   `json:"error,omitempty"`
 }
 
 type MessageUploadResponse struct {
@@ -117,7 +138,7 @@ type HeaderCache struct {
 	port              uint16
 	baseurl           string
 	wsurl             string
-	db                *leveldb.DB
+	db                *HeaderIndex
 	syncMutex         sync.Mutex
 	syncInProgress    bool
 	status            StatusResponse
@@ -128,16 +149,40 @@ type HeaderCache struct {
 	NetworkErrors     int
 	PeerInfo          []PeerItemResponse
 	wsclient          cwebsocket.ClientConnection
+	pow               PoWPolicy
 }
 
 // NOTE : if dbpath is empty ("") header cache will be in-memory only
 
 func OpenHeaderCache(host string, port uint16, dbpath string) (hc *HeaderCache, err error) {
+	var kv KVStore
+	if len(dbpath) == 0 {
+		kv = NewMemKVStore()
+	} else {
+		kv, err = OpenLevelDBStore(dbpath)
+		if err != nil {
+			//fmt.Printf("whoops4", err)
+			return nil, err
+		}
+	}
+
+	hc, err = OpenHeaderCacheKV(host, port, kv)
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return hc, nil
+}
+
+// OpenHeaderCacheKV opens a cache of the headers held by the peer at
+// host:port, keeping them in kv
+func OpenHeaderCacheKV(host string, port uint16, kv KVStore) (hc *HeaderCache, err error) {
 	hc = new(HeaderCache)
 	hc.baseurl = fmt.Sprintf("http://%s:%d/", host, port)
 	hc.wsurl = fmt.Sprintf("ws://%s:%d/", host, port)
 	hc.host = host
 	hc.port = port
+	hc.pow = DefaultPoWPolicy
 
 	c := &http.Client{
 		Timeout: time.Second * 10,
@@ -160,17 +205,9 @@ func OpenHeaderCache(host string, port uint16, dbpath string) (hc *HeaderCache,
 		//fmt.Printf("failed to marshall result\n", err)
 		return nil, err
 	}
+	hc.pow = PoWPolicyFromStatus(hc.status.PoW)
 
-	if len(dbpath) == 0 {
-		//fmt.Printf("whoops3", err)
-		return nil, errors.New("refusing to open empty db path")
-	}
-
-	hc.db, err = leveldb.OpenFile(dbpath, nil)
-	if err != nil {
-		//fmt.Printf("whoops4", err)
-		return nil, err
-	}
+	hc.db = NewHeaderIndex(kv, true)
 
 	if hc.recoverCheckpoint() != nil {
 		err = hc.recount()
@@ -220,6 +257,7 @@ func (hc *HeaderCache) HandleWSTimeResponse(message int) {
 func (hc *HeaderCache) HandleWSStatusResponse(message StatusResponse) {
 	hc.NetworkErrors = 0
 	hc.status = message
+	hc.pow = PoWPolicyFromStatus(message.PoW)
 }
 
 func (hc *HeaderCache) HandleWSDisconnect() {
@@ -248,7 +286,7 @@ func (hc *HeaderCache) recount() (err error) {
 		return err
 	}
 
-	iter := hc.db.NewIterator(&util.Range{Start: expiredBegin, Limit: expiredEnd}, nil)
+	iter := hc.db.iter(expiredBegin, expiredEnd)
 
 	count := int(0)
 
@@ -264,7 +302,7 @@ func (hc *HeaderCache) recount() (err error) {
 
 func (hc *HeaderCache) Close() {
 	if hc.db != nil {
-		hc.db.Close()
+		hc.db.close()
 		hc.db = nil
 	}
 }
@@ -274,6 +312,8 @@ type dbkeys struct {
 	servertime []byte
 	expire     []byte
 	I          []byte
+	J          []byte
+	K          []byte
 }
 
 func serializeUint32(u uint32) []byte {
@@ -296,12 +336,12 @@ func (hc *HeaderCache) checkpoint() (err error) {
 	binary.Write(buf, binary.BigEndian, uint64(hc.Count))
 	value := buf.Bytes()[:]
 	key := []byte("\000\000\000\000")
-	return hc.db.Put(key, value, nil)
+	return hc.db.putMeta(key, value)
 }
 
 func (hc *HeaderCache) recoverCheckpoint() (err error) {
 	key := []byte("\000\000\000\000")
-	value, err := hc.db.Get(key, nil)
+	value, err := hc.db.get(key)
 	if err != nil {
 		return err
 	}
@@ -316,14 +356,24 @@ func (hc *HeaderCache) recoverCheckpoint() (err error) {
 	return nil
 }
 
+// SetPoWPolicy sets the policy used to validate headers on Insert, replacing
+// the policy advertised by the peer (until its next status update)
+func (hc *HeaderCache) SetPoWPolicy(p PoWPolicy) {
+	hc.pow = p
+}
+
 func (hc *HeaderCache) Insert(h MessageHeader) (insert bool, err error) {
+	err = CheckPoW(hc.pow, h)
+	if err != nil {
+		return false, err
+	}
 	servertime := uint32(time.Now().Unix())
 	dbk, err := h.dbKeys(servertime)
 	if err != nil {
 		fmt.Printf("HeaderCache.Insert: dbKeys returned error\n")
 		return false, err
 	}
-	_, err = hc.db.Get(dbk.I, nil)
+	_, err = hc.db.get(dbk.I)
 	if err == nil {
 		return false, nil
 	}
@@ -331,12 +381,7 @@ func (hc *HeaderCache) Insert(h MessageHeader) (insert bool, err error) {
 	value := append([]byte(h.Serialize())[:], serializeUint32(servertime)[:]...)
 	//fmt.Printf("%d\n", len(value))
 	//value := h.Serialize()[:]
-	batch := new(leveldb.Batch)
-	batch.Put(dbk.date, value)
-	batch.Put(dbk.servertime, value)
-	batch.Put(dbk.expire, value)
-	batch.Put(dbk.I, value)
-	err = hc.db.Write(batch, nil)
+	err = hc.db.insert(dbk, value)
 	if err != nil {
 		return false, err
 	}
@@ -345,28 +390,23 @@ func (hc *HeaderCache) Insert(h MessageHeader) (insert bool, err error) {
 }
 
 func (hc *HeaderCache) Remove(h MessageHeader) (err error) {
-	value, err := hc.db.Get(h.IKey(), nil)
+	value, err := hc.db.get(h.IKey())
 	if err != nil {
 		return err
 	}
-	servertime := deserializeUint32(value[MessageHeaderLengthB64V2 : MessageHeaderLengthB64V2+4])
+	servertime := deserializeUint32(value[len(value)-4:])
 	dbk, err := h.dbKeys(servertime)
 	if err != nil {
 		return err
 	}
-	batch := new(leveldb.Batch)
-	batch.Delete(dbk.date)
-	batch.Delete(dbk.servertime)
-	batch.Delete(dbk.expire)
-	batch.Delete(dbk.I)
 	hc.Count -= 1
-	return hc.db.Write(batch, nil)
+	return hc.db.remove(dbk)
 }
 
 func (hc *HeaderCache) FindByI(I []byte) (h MessageHeader, err error) {
 	hc.Sync()
 
-	value, err := hc.db.Get(I, nil)
+	value, err := hc.db.get(I)
 	if err != nil {
 		return nil, err
 	}
@@ -378,64 +418,37 @@ func (hc *HeaderCache) FindByI(I []byte) (h MessageHeader, err error) {
 	return h, nil
 }
 
-func (hc *HeaderCache) FindSince(tstamp uint32) (hdrs []RawMessageHeader, err error) {
-	hc.Sync()
-
-	emptyMessage := "000000000000000000000000000000000000000000000000000000000000000000"
-	tag1 := fmt.Sprintf("C0%08X%s", tstamp, emptyMessage)
-	tag2 := "C0" + "FFFFFFFF" + emptyMessage
+func (hc *HeaderCache) FindSince(tstamp uint32) (hdrs []CompactMessageHeader, err error) {
+	return collectHeaders(hc.IterSince(tstamp, 0))
+}
 
-	bin1, err := hex.DecodeString(tag1)
-	if err != nil {
-		return nil, err
-	}
-	bin2, err := hex.DecodeString(tag2)
-	if err != nil {
-		return nil, err
-	}
+// IterSince iterates over headers received by the peer at or after tstamp
+// (servertime), stopping after limit headers if limit > 0
+func (hc *HeaderCache) IterSince(tstamp uint32, limit int) HeaderIterator {
+	hc.Sync()
 
-	iter := hc.db.NewIterator(&util.Range{Start: bin1, Limit: bin2}, nil)
+	start, end := timeRange(indexPrefixServertime, tstamp)
+	return newHeaderIterator(hc.db, start, end, limit)
+}
 
-	hdrs = make([]RawMessageHeader, 0)
-	for iter.Next() {
-		h := new(RawMessageHeader)
-		value := iter.Value()
-		if h.Deserialize(string(value[0:len(value)-4])) != nil {
-			return nil, errors.New("error parsing message")
-		}
-		hdrs = append(hdrs, *h)
-	}
-	return hdrs, nil
+func (hc *HeaderCache) FindExpiringAfter(tstamp uint32) (hdrs []CompactMessageHeader, err error) {
+	return collectHeaders(hc.IterExpiringAfter(tstamp, 0))
 }
 
-func (hc *HeaderCache) FindExpiringAfter(tstamp uint32) (hdrs []RawMessageHeader, err error) {
+// IterExpiringAfter iterates over headers expiring at or after tstamp,
+// stopping after limit headers if limit > 0
+func (hc *HeaderCache) IterExpiringAfter(tstamp uint32, limit int) HeaderIterator {
 	hc.Sync()
 
-	emptyMessage := "000000000000000000000000000000000000000000000000000000000000000000"
-	tag1 := fmt.Sprintf("E0%08X%s", tstamp, emptyMessage)
-	tag2 := "E0" + "FFFFFFFF" + emptyMessage
-
-	bin1, err := hex.DecodeString(tag1)
-	if err != nil {
-		return nil, err
-	}
-	bin2, err := hex.DecodeString(tag2)
-	if err != nil {
-		return nil, err
-	}
+	start, end := timeRange(indexPrefixExpire, tstamp)
+	return newHeaderIterator(hc.db, start, end, limit)
+}
 
-	iter := hc.db.NewIterator(&util.Range{Start: bin1, Limit: bin2}, nil)
+// IterCursor resumes the iteration which returned the cursor c
+func (hc *HeaderCache) IterCursor(c HeaderCursor, limit int) HeaderIterator {
+	hc.Sync()
 
-	hdrs = make([]RawMessageHeader, 0)
-	for iter.Next() {
-		h := new(RawMessageHeader)
-		value := iter.Value()
-		if h.Deserialize(string(value[0:len(value)-4])) != nil {
-			return nil, errors.New("error parsing message")
-		}
-		hdrs = append(hdrs, *h)
-	}
-	return hdrs, nil
+	return newHeaderCursorIterator(hc.db, c, limit)
 }
 
 func (hc *HeaderCache) UpdateTime(serverTime uint32) (err error) {
@@ -499,13 +512,19 @@ func (hc *HeaderCache) getHeadersSince(since uint32) (mh []RawMessageHeader, err
 	if err != nil {
 		return nil, err
 	}
+	if s.Error != "" {
+		hc.NetworkErrors += 1
+		return nil, fmt.Errorf("incomplete header list: %s", s.Error)
+	}
 
 	hc.NetworkErrors = 0
 	mh = make([]RawMessageHeader, 0)
 	for _, hdr := range s.Headers {
 		h := new(RawMessageHeader)
-		if h.Deserialize(hdr) != nil {
-			return nil, errors.New("error parsing message")
+		err = h.DeserializeStrict(hdr)
+		if err != nil {
+			fmt.Printf("HC(%s): dropping invalid header: %s\n", hc.baseurl, err)
+			continue
 		}
 		mh = append(mh, *h)
 	}
@@ -524,8 +543,8 @@ func (hc *HeaderCache) pruneExpired() (err error) {
 		return err
 	}
 
-	iter := hc.db.NewIterator(&util.Range{Start: expiredBegin, Limit: expiredEnd}, nil)
-	batch := new(leveldb.Batch)
+	iter := hc.db.iter(expiredBegin, expiredEnd)
+	batch := new(KVBatch)
 	hdr := new(RawMessageHeader)
 
 	delCount := int(0)
@@ -544,15 +563,12 @@ func (hc *HeaderCache) pruneExpired() (err error) {
 			fmt.Printf("HC(%s): failed to generate dbkeys\n", hc.baseurl)
 			continue
 		}
-		batch.Delete(dbk.date)
-		batch.Delete(dbk.servertime)
-		batch.Delete(dbk.expire)
-		batch.Delete(dbk.I)
+		hc.db.batchRemove(batch, dbk)
 		delCount += 1
 	}
 	iter.Release()
 
-	err = hc.db.Write(batch, nil)
+	err = hc.db.write(batch)
 	if err == nil {
 		hc.Count -= delCount
 		//fmt.Printf("HC(%s) dropping %d message headers\n", hc.baseurl, delCount)
@@ -712,10 +728,10 @@ func (hc *HeaderCache) tryDownloadMessage(I []byte, recvpath string) (m *Message
 
 	f.Close()
 
-	m = Ingest(recvpath)
-	if m == nil {
+	m, err = Ingest(recvpath)
+	if err != nil {
 		os.Remove(recvpath)
-		return nil, fmt.Errorf("Error receiving file to %s", recvpath)
+		return nil, fmt.Errorf("Error receiving file to %s: %s", recvpath, err)
 	}
 
 	hc.NetworkErrors = 0
@@ -822,6 +838,7 @@ type PeerJSON struct {
 	Messages int    `json:"messages"`
 	Start    int    `json:"start"`
 	Ring     int    `json:"ring"`
+	Sectors  string `json:"sectors"`
 }
 
 func (hc *HeaderCache) GetPeerStatsJSON() (stats *PeerJSON) {
@@ -833,5 +850,6 @@ func (hc *HeaderCache) GetPeerStatsJSON() (stats *PeerJSON) {
 	pi.Messages = hc.status.Storage.Messages
 	pi.Start = hc.status.Sector.Start
 	pi.Ring = int(hc.status.Sector.Ring)
+	pi.Sectors = hc.status.SectorSet().String()
 	return pi
 }
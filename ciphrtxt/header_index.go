@@ -0,0 +1,329 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"errors"
+)
+
+// index key prefixes. The time indexes are followed by a 32 bit (big endian)
+// time and I, the recipient indexes by J or K and I.
+const (
+	indexPrefixJ          = 0xA0
+	indexPrefixK          = 0xB0
+	indexPrefixServertime = 0xC0
+	indexPrefixDate       = 0xD0
+	indexPrefixExpire     = 0xE0
+	indexPrefixJournal    = 0xF0
+)
+
+// ErrRecipientIndexDisabled is returned by FindByJ and FindByK if the
+// recipient index has not been enabled
+var ErrRecipientIndexDisabled = errors.New("recipient index not enabled")
+
+// HeaderIndex keeps header (or message file) records in a KVStore. Each
+// record is stored under the message ID I and under the servertime
+// (C0 || servertime || I) and expire (E0 || expire || I) indexes. The header
+// caches also maintain the message time index (D0 || time || I). The
+// recipient indexes (A0 || J || I and B0 || K || I) are optional.
+type HeaderIndex struct {
+	kv        KVStore
+	date      bool
+	recipient bool
+}
+
+func NewHeaderIndex(kv KVStore, date bool) *HeaderIndex {
+	return &HeaderIndex{kv: kv, date: date}
+}
+
+func (x *HeaderIndex) get(I []byte) (value []byte, err error) {
+	return x.kv.Get(I)
+}
+
+func (x *HeaderIndex) has(I []byte) bool {
+	_, err := x.kv.Get(I)
+	return err == nil
+}
+
+func (x *HeaderIndex) batchInsert(b *KVBatch, dbk *dbkeys, value []byte) {
+	if x.date {
+		b.Put(dbk.date, value)
+	}
+	if x.recipient {
+		b.Put(dbk.J, value)
+		b.Put(dbk.K, value)
+	} else {
+		b.Delete(recipientIndexKey)
+	}
+	b.Put(dbk.servertime, value)
+	b.Put(dbk.expire, value)
+	b.Put(dbk.I, value)
+}
+
+func (x *HeaderIndex) batchRemove(b *KVBatch, dbk *dbkeys) {
+	if x.date {
+		b.Delete(dbk.date)
+	}
+	if x.recipient {
+		b.Delete(dbk.J)
+		b.Delete(dbk.K)
+	} else {
+		b.Delete(recipientIndexKey)
+	}
+	b.Delete(dbk.servertime)
+	b.Delete(dbk.expire)
+	b.Delete(dbk.I)
+}
+
+func (x *HeaderIndex) insert(dbk *dbkeys, value []byte) error {
+	b := new(KVBatch)
+	x.batchInsert(b, dbk, value)
+	return x.kv.Write(b)
+}
+
+func (x *HeaderIndex) remove(dbk *dbkeys) error {
+	b := new(KVBatch)
+	x.batchRemove(b, dbk)
+	return x.kv.Write(b)
+}
+
+func (x *HeaderIndex) write(b *KVBatch) error {
+	return x.kv.Write(b)
+}
+
+// iter iterates over records with keys in [start, limit)
+func (x *HeaderIndex) iter(start []byte, limit []byte) KVIterator {
+	return x.kv.NewIterator(start, limit)
+}
+
+// iterPrefix iterates over the index prefix for keys beginning with p
+func (x *HeaderIndex) iterPrefix(prefix byte, p []byte) KVIterator {
+	start := append([]byte{prefix}, p...)
+	limit := append([]byte{}, start...)
+	for i := len(limit) - 1; i >= 0; i-- {
+		if limit[i] < 0xFF {
+			limit[i] += 1
+			limit = limit[:i+1]
+			break
+		}
+	}
+	return x.kv.NewIterator(start, limit)
+}
+
+// recipientIndexKey marks a store whose recipient indexes are complete. Any
+// record written while the recipient index is disabled clears the marker.
+var recipientIndexKey = []byte("\000\000\000\006")
+
+// indexRebuildBatch limits the number of records per batch when rebuilding
+// an index
+const indexRebuildBatch = 1024
+
+// rebuild calls fn for each record in [start, limit), writing the updates
+// in batches of indexRebuildBatch records
+func (x *HeaderIndex) rebuild(start []byte, limit []byte, fn func(b *KVBatch, key []byte, value []byte)) error {
+	b := new(KVBatch)
+	n := 0
+	iter := x.kv.NewIterator(start, limit)
+	defer iter.Release()
+	for iter.Next() {
+		fn(b, append([]byte{}, iter.Key()...), append([]byte{}, iter.Value()...))
+		n += 1
+		if n >= indexRebuildBatch {
+			err := x.kv.Write(b)
+			if err != nil {
+				return err
+			}
+			b = new(KVBatch)
+			n = 0
+		}
+	}
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+	return x.kv.Write(b)
+}
+
+// enableRecipient turns on the recipient indexes. As records are not
+// indexed while the index is disabled the index is rebuilt from the records
+// stored by I, using keys to recover the index keys from a record, unless
+// the store is marked as complete (recipientIndexKey).
+func (x *HeaderIndex) enableRecipient(keys func(value []byte) (*dbkeys, error)) (err error) {
+	if x.recipient {
+		return nil
+	}
+	_, err = x.kv.Get(recipientIndexKey)
+	if err == nil {
+		x.recipient = true
+		return nil
+	}
+	if err != ErrKVNotFound {
+		return err
+	}
+
+	err = x.rebuild([]byte{indexPrefixJ}, []byte{indexPrefixK + 1}, func(b *KVBatch, key []byte, value []byte) {
+		b.Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+	err = x.rebuild([]byte{0x02}, []byte{0x04}, func(b *KVBatch, key []byte, value []byte) {
+		dbk, err := keys(value)
+		if err != nil {
+			// unparseable records are skipped rather than failing the open
+			return
+		}
+		b.Put(dbk.J, value)
+		b.Put(dbk.K, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	x.recipient = true
+	return x.kv.Put(recipientIndexKey, []byte{1})
+}
+
+// dateIndexKey marks a store whose records have all been added to the date
+// index
+var dateIndexKey = []byte("\000\000\000\003")
+
+// enableDate turns on the message time index. The message store did not
+// always keep it, so the first time it is enabled for a store the index is
+// built from the records stored by I.
+func (x *HeaderIndex) enableDate(keys func(value []byte) (*dbkeys, error)) (err error) {
+	_, err = x.kv.Get(dateIndexKey)
+	if err == nil {
+		x.date = true
+		return nil
+	}
+	if err != ErrKVNotFound {
+		return err
+	}
+
+	err = x.rebuild([]byte{0x02}, []byte{0x04}, func(b *KVBatch, key []byte, value []byte) {
+		dbk, err := keys(value)
+		if err != nil {
+			// unparseable records are skipped rather than failing the open
+			return
+		}
+		b.Put(dbk.date, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = x.kv.Put(dateIndexKey, []byte{1})
+	if err != nil {
+		return err
+	}
+	x.date = true
+	return nil
+}
+
+// loadDate turns on the message time index if it has been built, without
+// building it
+func (x *HeaderIndex) loadDate() (err error) {
+	_, err = x.kv.Get(dateIndexKey)
+	if err == ErrKVNotFound {
+		return nil
+	}
+	x.date = err == nil
+	return err
+}
+
+// iterAll iterates over all records by I (compressed points, 02 or 03)
+func (x *HeaderIndex) iterAll() KVIterator {
+	return x.kv.NewIterator([]byte{0x02}, []byte{0x04})
+}
+
+// staleKeys returns the index keys (any prefix from A0 up to the journal)
+// which refer to an I with no record
+func (x *HeaderIndex) staleKeys() (stale [][]byte, err error) {
+	stale = make([][]byte, 0)
+	iter := x.kv.NewIterator([]byte{indexPrefixJ}, []byte{indexPrefixJournal})
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) < 34 {
+			continue
+		}
+		if !x.has(key[len(key)-33:]) {
+			stale = append(stale, append([]byte{}, key...))
+		}
+	}
+	return stale, iter.Error()
+}
+
+// journal entries (F0 || I) mark operations which update both the database
+// and the filesystem (see MessageStore)
+
+func journalKey(I []byte) []byte {
+	return append([]byte{indexPrefixJournal}, I...)
+}
+
+func (x *HeaderIndex) putJournal(I []byte, value []byte) error {
+	return x.kv.Put(journalKey(I), value)
+}
+
+func (x *HeaderIndex) batchJournal(b *KVBatch, I []byte, value []byte) {
+	b.Put(journalKey(I), value)
+}
+
+func (x *HeaderIndex) clearJournal(I []byte) error {
+	return x.kv.Delete(journalKey(I))
+}
+
+func (x *HeaderIndex) batchClearJournal(b *KVBatch, I []byte) {
+	b.Delete(journalKey(I))
+}
+
+func (x *HeaderIndex) hasJournal(I []byte) bool {
+	_, err := x.kv.Get(journalKey(I))
+	return err == nil
+}
+
+func (x *HeaderIndex) iterJournal() KVIterator {
+	return x.kv.NewIterator([]byte{indexPrefixJournal}, []byte{indexPrefixJournal + 1})
+}
+
+func (x *HeaderIndex) getMeta(key []byte) (value []byte, err error) {
+	return x.kv.Get(key)
+}
+
+func (x *HeaderIndex) putMeta(key []byte, value []byte) error {
+	return x.kv.Put(key, value)
+}
+
+func (x *HeaderIndex) deleteMeta(key []byte) error {
+	return x.kv.Delete(key)
+}
+
+func (x *HeaderIndex) close() error {
+	return x.kv.Close()
+}
@@ -0,0 +1,399 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// index keys in the time indexes are prefix || 32 bit time || I
+const timeIndexKeyLength = 1 + 4 + 33
+
+// HeaderCursor is the position of a record in one of the time indexes.
+// Iteration resumed from a cursor begins with the record following it.
+type HeaderCursor []byte
+
+func (c HeaderCursor) String() string {
+	return hex.EncodeToString(c)
+}
+
+// ParseHeaderCursor parses the hex string form of a cursor
+func ParseHeaderCursor(s string) (c HeaderCursor, err error) {
+	c, err = hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c HeaderCursor) validate() error {
+	if len(c) != timeIndexKeyLength {
+		return errors.New("invalid cursor length")
+	}
+	switch c[0] {
+	case indexPrefixServertime, indexPrefixDate, indexPrefixExpire:
+		return nil
+	}
+	return errors.New("invalid cursor index")
+}
+
+// timeRange returns the index keys covering prefix || tstamp through the end
+// of the index
+func timeRange(prefix byte, tstamp uint32) (start []byte, limit []byte) {
+	start = append([]byte{prefix}, serializeUint32(tstamp)...)
+	return start, []byte{prefix + 1}
+}
+
+// cursorRange returns the index keys following c through the end of the
+// index c belongs to
+func cursorRange(c HeaderCursor) (start []byte, limit []byte, err error) {
+	if err = c.validate(); err != nil {
+		return nil, nil, err
+	}
+	start = append(append([]byte{}, c...), 0x00)
+	return start, []byte{c[0] + 1}, nil
+}
+
+// dateRange returns the date index keys covering message times in
+// [from, to)
+func dateRange(from uint32, to uint32) (start []byte, limit []byte) {
+	start = append([]byte{indexPrefixDate}, serializeUint32(from)...)
+	limit = append([]byte{indexPrefixDate}, serializeUint32(to)...)
+	return start, limit
+}
+
+// dateCursorRange returns the date index keys following c for message times
+// before to
+func dateCursorRange(c HeaderCursor, to uint32) (start []byte, limit []byte, err error) {
+	if err = c.validate(); err != nil {
+		return nil, nil, err
+	}
+	if c[0] != indexPrefixDate {
+		return nil, nil, errors.New("cursor is not from a time range")
+	}
+	start = append(append([]byte{}, c...), 0x00)
+	limit = append([]byte{indexPrefixDate}, serializeUint32(to)...)
+	return start, limit, nil
+}
+
+// indexIterator walks a range of a HeaderIndex, stopping after limit records
+// (if limit > 0)
+type indexIterator struct {
+	iter  KVIterator
+	limit int
+	count int
+	key   []byte
+	err   error
+}
+
+func newIndexIterator(x *HeaderIndex, start []byte, end []byte, limit int) *indexIterator {
+	return &indexIterator{iter: x.iter(start, end), limit: limit}
+}
+
+func (it *indexIterator) next() (value []byte, ok bool) {
+	if (it.err != nil) || (it.iter == nil) {
+		return nil, false
+	}
+	if (it.limit > 0) && (it.count >= it.limit) {
+		return nil, false
+	}
+	if !it.iter.Next() {
+		it.err = it.iter.Error()
+		return nil, false
+	}
+	it.key = append(it.key[:0], it.iter.Key()...)
+	it.count += 1
+	return it.iter.Value(), true
+}
+
+func (it *indexIterator) cursor() HeaderCursor {
+	if it.key == nil {
+		return nil
+	}
+	return HeaderCursor(append([]byte{}, it.key...))
+}
+
+func (it *indexIterator) close() {
+	if it.iter != nil {
+		it.iter.Release()
+		it.iter = nil
+	}
+}
+
+// HeaderIterator iterates over the headers of a header cache in index order.
+// The header returned by Header is only valid until the next call to Next.
+// Iterators must be closed.
+type HeaderIterator interface {
+	Next() bool
+	Header() *CompactMessageHeader
+	Servertime() uint32
+	// Cursor returns the position of the current header, from which
+	// iteration may be resumed
+	Cursor() HeaderCursor
+	Err() error
+	Close()
+}
+
+// headerIterator decodes header cache records, which hold the serialized
+// header followed by the servertime
+type headerIterator struct {
+	indexIterator
+	h          CompactMessageHeader
+	servertime uint32
+}
+
+func newHeaderIterator(x *HeaderIndex, start []byte, end []byte, limit int) *headerIterator {
+	return &headerIterator{indexIterator: *newIndexIterator(x, start, end, limit)}
+}
+
+func newHeaderCursorIterator(x *HeaderIndex, c HeaderCursor, limit int) *headerIterator {
+	start, end, err := cursorRange(c)
+	if err != nil {
+		return &headerIterator{indexIterator: indexIterator{err: err}}
+	}
+	return newHeaderIterator(x, start, end, limit)
+}
+
+func newHeaderDateCursorIterator(x *HeaderIndex, c HeaderCursor, to uint32, limit int) *headerIterator {
+	start, end, err := dateCursorRange(c, to)
+	if err != nil {
+		return &headerIterator{indexIterator: indexIterator{err: err}}
+	}
+	return newHeaderIterator(x, start, end, limit)
+}
+
+func (it *headerIterator) Next() bool {
+	value, ok := it.next()
+	if !ok {
+		return false
+	}
+	if (len(value) < 4) || (it.h.Deserialize(string(value[:len(value)-4])) != nil) {
+		it.err = errors.New("error parsing message header")
+		return false
+	}
+	it.servertime = deserializeUint32(value[len(value)-4:])
+	return true
+}
+
+func (it *headerIterator) Header() *CompactMessageHeader {
+	return &it.h
+}
+
+func (it *headerIterator) Servertime() uint32 {
+	return it.servertime
+}
+
+func (it *headerIterator) Cursor() HeaderCursor {
+	return it.cursor()
+}
+
+func (it *headerIterator) Err() error {
+	return it.err
+}
+
+func (it *headerIterator) Close() {
+	it.close()
+}
+
+// collectHeaders drains and closes it
+func collectHeaders(it HeaderIterator) (hdrs []CompactMessageHeader, err error) {
+	defer it.Close()
+	hdrs = make([]CompactMessageHeader, 0)
+	for it.Next() {
+		hdrs = append(hdrs, *it.Header())
+	}
+	if err = it.Err(); err != nil {
+		return nil, err
+	}
+	return hdrs, nil
+}
+
+// MessageIterator iterates over the message store in index order. The
+// message returned by Message is only valid until the next call to Next.
+// Iterators must be closed.
+type MessageIterator interface {
+	Next() bool
+	Message() *MessageFile
+	Servertime() uint32
+	Cursor() HeaderCursor
+	Err() error
+	Close()
+}
+
+type messageIterator struct {
+	indexIterator
+	m MessageFile
+}
+
+func newMessageIterator(x *HeaderIndex, start []byte, end []byte, limit int) *messageIterator {
+	return &messageIterator{indexIterator: *newIndexIterator(x, start, end, limit)}
+}
+
+func newMessageCursorIterator(x *HeaderIndex, c HeaderCursor, limit int) *messageIterator {
+	start, end, err := cursorRange(c)
+	if err != nil {
+		return &messageIterator{indexIterator: indexIterator{err: err}}
+	}
+	return newMessageIterator(x, start, end, limit)
+}
+
+func newMessageDateCursorIterator(x *HeaderIndex, c HeaderCursor, to uint32, limit int) *messageIterator {
+	start, end, err := dateCursorRange(c, to)
+	if err != nil {
+		return &messageIterator{indexIterator: indexIterator{err: err}}
+	}
+	return newMessageIterator(x, start, end, limit)
+}
+
+func (it *messageIterator) Next() bool {
+	value, ok := it.next()
+	if !ok {
+		return false
+	}
+	it.m = MessageFile{}
+	if it.m.Deserialize(value) == nil {
+		it.err = errors.New("error parsing message")
+		return false
+	}
+	return true
+}
+
+func (it *messageIterator) Message() *MessageFile {
+	return &it.m
+}
+
+func (it *messageIterator) Servertime() uint32 {
+	return it.m.Servertime
+}
+
+func (it *messageIterator) Cursor() HeaderCursor {
+	return it.cursor()
+}
+
+func (it *messageIterator) Err() error {
+	return it.err
+}
+
+func (it *messageIterator) Close() {
+	it.close()
+}
+
+// collectMessages drains and closes it
+func collectMessages(it MessageIterator) (msgs []MessageFile, err error) {
+	defer it.Close()
+	msgs = make([]MessageFile, 0)
+	for it.Next() {
+		msgs = append(msgs, *it.Message())
+	}
+	if err = it.Err(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// streamJSONList writes {"<name>":[...],"cursor":"..."} to w, taking list
+// entries from next until it returns false. The cursor is only written if
+// more is true (i.e. the list was cut short by a limit). If the list ended
+// on an error the error is written instead of the cursor, so the client can
+// tell the list is incomplete.
+func streamJSONList(w io.Writer, name string, next func() (string, bool), status func() (c HeaderCursor, more bool, err error)) (err error) {
+	if _, err = io.WriteString(w, "{\""+name+"\":["); err != nil {
+		return err
+	}
+	for first := true; ; first = false {
+		s, ok := next()
+		if !ok {
+			break
+		}
+		b, _ := json.Marshal(s)
+		if !first {
+			b = append([]byte{','}, b...)
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+	}
+	tail := "]"
+	c, more, lerr := status()
+	if lerr != nil {
+		b, _ := json.Marshal(lerr.Error())
+		tail += ",\"error\":" + string(b)
+	} else if more && (c != nil) {
+		tail += ",\"cursor\":\"" + c.String() + "\""
+	}
+	_, err = io.WriteString(w, tail+"}")
+	return err
+}
+
+// WriteHeaderList streams the headers from it to w as a HeaderListResponse
+// and closes it. If limit headers were written the response includes the
+// cursor to continue from.
+func WriteHeaderList(w io.Writer, it HeaderIterator, limit int) (err error) {
+	defer it.Close()
+	count := 0
+	err = streamJSONList(w, "header_list", func() (string, bool) {
+		if !it.Next() {
+			return "", false
+		}
+		count += 1
+		return it.Header().Serialize(), true
+	}, func() (HeaderCursor, bool, error) {
+		return it.Cursor(), (limit > 0) && (count >= limit), it.Err()
+	})
+	if err != nil {
+		return err
+	}
+	return it.Err()
+}
+
+// WriteMessageList streams the message IDs from it to w as a
+// MessageListResponse and closes it. If limit messages were written the
+// response includes the cursor to continue from.
+func WriteMessageList(w io.Writer, it MessageIterator, limit int) (err error) {
+	defer it.Close()
+	count := 0
+	err = streamJSONList(w, "message_list", func() (string, bool) {
+		if !it.Next() {
+			return "", false
+		}
+		count += 1
+		return hex.EncodeToString(it.Message().IKey()), true
+	}, func() (HeaderCursor, bool, error) {
+		return it.Cursor(), (limit > 0) && (count >= limit), it.Err()
+	})
+	if err != nil {
+		return err
+	}
+	return it.Err()
+}
@@ -29,6 +29,7 @@ package ciphrtxt
 
 import (
 	"bytes"
+	"context"
 	"testing"
 	//"math/big"
 	"encoding/base64"
@@ -39,10 +40,17 @@ import (
 	"math/big"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
 	"sort"
 	"strconv"
 	"sync"
+	"testing/quick"
 	"time"
+
+	"github.com/jadeblaquiere/cttd/btcec"
 )
 
 type THeaderListResponse struct {
@@ -107,7 +115,7 @@ func TestMessageHeaderInterface(t *testing.T) {
 		}
 		sfh := validate(fh)
 		if len(sfh) == 0 {
-			fmt.Printf("Error validating header\n", err)
+			fmt.Printf("Error validating header %s\n", err)
 			t.Fail()
 		}
 	}
@@ -514,6 +522,465 @@ func TestHashvals(t *testing.T) {
 	}
 }
 
+func TestVerifySignature(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := new(RawMessageHeader)
+	h.version = "0200"
+	h.time = uint32(time.Now().Unix())
+	h.expire = h.time + 3600
+	h.I = priv.PubKey().SerializeCompressed()
+	h.J = priv.PubKey().SerializeCompressed()
+	h.K = priv.PubKey().SerializeCompressed()
+	h.blocklen = 1
+	h.r = make([]byte, 32)
+	h.s = make([]byte, 32)
+
+	body := bytes.Repeat([]byte("A"), MessageHeaderLengthB64V2)
+	hash, err := h.signatureHash(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := priv.Sign(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.r = padbytes(sig.R, 32)
+	h.s = padbytes(sig.S, 32)
+
+	err = h.Verify(bytes.NewReader(body))
+	if err != nil {
+		fmt.Println("valid signature rejected:", err)
+		t.Fail()
+	}
+
+	fh := new(FullMessageHeader)
+	err = fh.ImportBytes(h.ExportBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fh.Verify(bytes.NewReader(body))
+	if err != nil {
+		fmt.Println("valid signature rejected (full header):", err)
+		t.Fail()
+	}
+
+	// tampered body
+	body[0] = 'B'
+	err = h.Verify(bytes.NewReader(body))
+	if _, ok := err.(*SignatureError); !ok {
+		fmt.Println("tampered body not rejected:", err)
+		t.Fail()
+	}
+	body[0] = 'A'
+
+	// tampered header
+	h.expire += 1
+	err = h.Verify(bytes.NewReader(body))
+	if _, ok := err.(*SignatureError); !ok {
+		fmt.Println("tampered header not rejected:", err)
+		t.Fail()
+	}
+}
+
+func TestDeserializeStrict(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMessage(priv.PubKey(), []byte("strict"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := m.Serialize()
+
+	h := new(RawMessageHeader)
+	err = h.DeserializeStrict(valid)
+	if err != nil {
+		fmt.Println("DeserializeStrict rejected valid header:", err)
+		t.Fail()
+	}
+	err = h.ImportBytesStrict(m.ExportBytes())
+	if err != nil {
+		fmt.Println("ImportBytesStrict rejected valid header:", err)
+		t.Fail()
+	}
+
+	// arbitrary input must not panic
+	for l := 0; l < 400; l++ {
+		b := make([]byte, l)
+		rand.Read(b)
+		h.DeserializeStrict(string(b))
+		h.ImportBytesStrict(b)
+		h.Deserialize(string(b))
+		h.ImportBytes(b)
+		if l > 3 {
+			copy(b, "M01")
+			h.DeserializeStrict(string(b))
+			h.Deserialize(string(b))
+		}
+		h.DeserializeStrict(valid[:l%len(valid)])
+		h.Deserialize(valid[:l%len(valid)])
+	}
+
+	corrupt := func(offset int, value byte) string {
+		bmh := m.ExportBytes()
+		bmh[offset] = value
+		return base64.StdEncoding.EncodeToString(bmh)
+	}
+	cases := []struct {
+		hdr   string
+		field string
+	}{
+		{valid[:MessageHeaderLengthB64V2-4], "header"},
+		{valid + "AAAA", "header"},
+		{"!" + valid[1:], "header"},
+		{corrupt(0, 'N'), "version"},
+		{corrupt(12, 0x04), "I"},
+		{corrupt(45, 0x00), "J"},
+		{corrupt(78, 0x05), "K"},
+		{corrupt(122, 0x01), "reserved"},
+	}
+	for _, c := range cases {
+		err = h.DeserializeStrict(c.hdr)
+		herr, ok := err.(*HeaderFieldError)
+		if !ok {
+			fmt.Printf("expected HeaderFieldError (%s), got %v\n", c.field, err)
+			t.Fail()
+			continue
+		}
+		if herr.Field != c.field {
+			fmt.Printf("expected error in field %s, got %s\n", c.field, herr)
+			t.Fail()
+		}
+	}
+}
+
+func TestMineNonce(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMessage(priv.PubKey(), []byte("mine me"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &m.RawMessageHeader
+
+	for _, bits := range []int{0, 4, 8, 12, 16, 20} {
+		err = MineNonce(h, bits, 0, context.Background(), nil)
+		if err != nil {
+			fmt.Printf("MineNonce(%d bits) failed: %s\n", bits, err)
+			t.Fail()
+			continue
+		}
+		if !hashMeetsTarget(h.Hash(), bits) {
+			fmt.Printf("MineNonce(%d bits) nonce %d does not meet target\n", bits, h.nonce)
+			t.Fail()
+		}
+	}
+
+	// 64 bits will not be found, cancel after a short delay
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+	progressCalls := 0
+	err = MineNonce(h, 64, 0, ctx, func(hashes uint64) {
+		progressCalls += 1
+	})
+	if err != context.DeadlineExceeded {
+		fmt.Println("MineNonce expected DeadlineExceeded, got", err)
+		t.Fail()
+	}
+	if progressCalls == 0 {
+		fmt.Println("MineNonce progress callback not called")
+		t.Fail()
+	}
+}
+
+func TestPoWPolicy(t *testing.T) {
+	sp := &ScaledPoWPolicy{
+		BaseBits:  16,
+		BlockUnit: 64,
+		TimeUnit:  (8 * 24 * 3600),
+		MaxBits:   24,
+	}
+	cases := []struct {
+		blocklen uint32
+		lifetime uint32
+		bits     int
+	}{
+		{1, 3600, 16},
+		{63, (7 * 24 * 3600), 16},
+		{64, (7 * 24 * 3600), 17},
+		{128, (7 * 24 * 3600), 18},
+		{1, (8 * 24 * 3600), 17},
+		{256, (32 * 24 * 3600), 22},
+		{0xFFFFFFFF, 0xFFFFFFFF, 24},
+	}
+	for _, c := range cases {
+		nbits := sp.RequiredBits(c.blocklen, c.lifetime)
+		if nbits != c.bits {
+			fmt.Printf("ScaledPoWPolicy(%d, %d) = %d, expected %d\n", c.blocklen, c.lifetime, nbits, c.bits)
+			t.Fail()
+		}
+	}
+
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMessage(priv.PubKey(), []byte("policy"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckPoW(DefaultPoWPolicy, m)
+	if err != nil {
+		fmt.Println("CheckPoW rejected message at network target:", err)
+		t.Fail()
+	}
+	err = CheckPoW(&FixedPoWPolicy{Bits: 256}, m)
+	if _, ok := err.(*PoWError); !ok {
+		fmt.Println("CheckPoW expected PoWError, got", err)
+		t.Fail()
+	}
+
+	// peers advertise their policy in the status response
+	for _, p := range []PoWPolicy{sp, &FixedPoWPolicy{Bits: 20}} {
+		if PoWPolicyFromStatus(p.Status()).Status() != p.Status() {
+			fmt.Println("PoWPolicyFromStatus mismatch for", p.Status())
+			t.Fail()
+		}
+	}
+	for _, s := range []PoWPolicyStatus{{}, {Algorithm: "sha256", Policy: "fixed", BaseBits: 8}, {Algorithm: "sha256", Policy: "other", BaseBits: 20}} {
+		if PoWPolicyFromStatus(s) != DefaultPoWPolicy {
+			fmt.Println("PoWPolicyFromStatus expected default for", s)
+			t.Fail()
+		}
+	}
+}
+
+func BenchmarkMineNonce(b *testing.B) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		b.Fatal(err)
+	}
+	m, err := NewMessage(priv.PubKey(), []byte("mine me"), time.Hour)
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := &m.RawMessageHeader
+
+	// mine to the network target (16 bits), starting from a fresh header each
+	// iteration so that found nonces are not re-used
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.time += 1
+		err = MineNonce(h, MessageHashTargetBits, 0, context.Background(), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCompactMessageHeader(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := NewMessage(priv.PubKey(), []byte("compact"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m3, err := NewMessageWithExtensions(priv.PubKey(), []byte("compact"), time.Hour, []HeaderExtension{{HeaderExtContentClass, []byte("text")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []*RawMessageHeader{&m2.RawMessageHeader, &m3.RawMessageHeader} {
+		s := h.Serialize()
+		c := h.Compact()
+		if c.Serialize() != s || c.Raw().Serialize() != s {
+			fmt.Println("compact header Serialize mismatch")
+			t.Fail()
+		}
+		if !bytes.Equal(c.Hash(), h.Hash()) || !bytes.Equal(c.ExportBytes(), h.ExportBytes()) {
+			fmt.Println("compact header Hash/ExportBytes mismatch")
+			t.Fail()
+		}
+		if !bytes.Equal(c.IKey(), h.I) || !bytes.Equal(c.JKey(), h.J) || !bytes.Equal(c.KKey(), h.K) || c.BlockLen() != h.blocklen || c.Nonce() != h.nonce {
+			fmt.Println("compact header accessor mismatch")
+			t.Fail()
+		}
+
+		var d, e CompactMessageHeader
+		err = d.Deserialize(s)
+		if err != nil || d.Serialize() != s {
+			fmt.Println("compact header Deserialize failed:", err)
+			t.Fail()
+		}
+		err = e.ImportBytes(h.ExportBytes())
+		if err != nil || e.Serialize() != s {
+			fmt.Println("compact header ImportBytes failed:", err)
+			t.Fail()
+		}
+
+		// database keys must match the original hex formatted keys
+		dbk, _ := c.dbKeys(0x12345678)
+		date, _ := hex.DecodeString(fmt.Sprintf("D0%08X", h.time))
+		stime, _ := hex.DecodeString("C012345678")
+		expire, _ := hex.DecodeString(fmt.Sprintf("E0%08X", h.expire))
+		if !bytes.Equal(dbk.date, append(date, h.I...)) || !bytes.Equal(dbk.servertime, append(stime, h.I...)) || !bytes.Equal(dbk.expire, append(expire, h.I...)) || !bytes.Equal(dbk.I, h.I) {
+			fmt.Println("compact header dbKeys mismatch")
+			t.Fail()
+		}
+	}
+
+	// sort order matches RawMessageHeaderSlice
+	raw := benchHeaders(1000)
+	compact := make([]CompactMessageHeader, len(raw))
+	for i := range raw {
+		compact[i] = raw[i].Compact()
+	}
+	sort.Sort(RawMessageHeaderSlice(raw))
+	sort.Sort(CompactMessageHeaderSlice(compact))
+	for i := range raw {
+		if compact[i].Serialize() != raw[i].Serialize() {
+			fmt.Printf("sort order mismatch at %d\n", i)
+			t.Fail()
+			break
+		}
+	}
+}
+
+// benchHeaders generates n (unsigned, unmined) V2 headers with random I and
+// times within the last hour
+func benchHeaders(n int) []RawMessageHeader {
+	now := uint32(time.Now().Unix())
+	hdrs := make([]RawMessageHeader, n)
+	for i := range hdrs {
+		h := &hdrs[i]
+		h.version = "0200"
+		h.time = now - uint32(rand.Intn(3600))
+		h.expire = h.time + 3600
+		h.I = make([]byte, 33)
+		rand.Read(h.I)
+		h.I[0] = 0x02 | (h.I[0] & 0x01)
+		h.J = make([]byte, 33)
+		rand.Read(h.J)
+		h.K = make([]byte, 33)
+		rand.Read(h.K)
+		h.blocklen = 1
+		h.r = make([]byte, 32)
+		h.s = make([]byte, 32)
+	}
+	return hdrs
+}
+
+const benchHeaderCount = 10000
+
+func BenchmarkSortRawMessageHeader(b *testing.B) {
+	hdrs := benchHeaders(benchHeaderCount)
+	work := make([]RawMessageHeader, len(hdrs))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(work, hdrs)
+		sort.Sort(RawMessageHeaderSlice(work))
+	}
+}
+
+func BenchmarkSortCompactMessageHeader(b *testing.B) {
+	raw := benchHeaders(benchHeaderCount)
+	hdrs := make([]CompactMessageHeader, len(raw))
+	for i := range raw {
+		hdrs[i] = raw[i].Compact()
+	}
+	work := make([]CompactMessageHeader, len(hdrs))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(work, hdrs)
+		sort.Sort(CompactMessageHeaderSlice(work))
+	}
+}
+
+func BenchmarkDeserializeRawMessageHeader(b *testing.B) {
+	s := benchHeaders(1)[0].Serialize()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h := new(RawMessageHeader)
+		h.Deserialize(s)
+	}
+}
+
+func BenchmarkDeserializeCompactMessageHeader(b *testing.B) {
+	s := benchHeaders(1)[0].Serialize()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var h CompactMessageHeader
+		h.Deserialize(s)
+	}
+}
+
+// benchLocalHeaderCache opens an empty local header cache which accepts
+// unmined headers
+func benchLocalHeaderCache(b *testing.B) (lhc *LocalHeaderCache, tmpdir string) {
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	lhc, err = OpenLocalHeaderCache(tmpdir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+	return lhc, tmpdir
+}
+
+func BenchmarkLocalFindSince(b *testing.B) {
+	lhc, tmpdir := benchLocalHeaderCache(b)
+	defer os.RemoveAll(tmpdir)
+	defer lhc.Close()
+
+	hdrs := benchHeaders(benchHeaderCount)
+	for i := range hdrs {
+		lhc.Insert(&hdrs[i])
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		found, err := lhc.FindSince(0)
+		if err != nil || len(found) != benchHeaderCount {
+			b.Fatal("FindSince failed")
+		}
+		sort.Sort(CompactMessageHeaderSlice(found))
+	}
+}
+
+// BenchmarkLocalSync measures inserting a peer's header list into the local
+// cache, as done by AddPeer and Sync
+func BenchmarkLocalSync(b *testing.B) {
+	raw := benchHeaders(benchHeaderCount)
+	hdrs := make([]CompactMessageHeader, len(raw))
+	for i := range raw {
+		hdrs[i] = raw[i].Compact()
+	}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		lhc, tmpdir := benchLocalHeaderCache(b)
+		b.StartTimer()
+		for j := range hdrs {
+			lhc.Insert(&hdrs[j])
+		}
+		b.StopTimer()
+		lhc.Close()
+		os.RemoveAll(tmpdir)
+		b.StartTimer()
+	}
+}
+
 func TestSortRawMessageHeader(t *testing.T) {
 	hc, err := OpenHeaderCache("violet.ciphrtxt.com", 7754, "testdb/violet.ciphrtxt.com")
 	if err != nil {
@@ -671,7 +1138,7 @@ func TestLocalFindByI(t *testing.T) {
 		t.Fail()
 	}
 
-	lhc.addPeer("indigo.ciphrtxt.com", 7754)
+	lhc.AddPeer("indigo.ciphrtxt.com", 7754)
 	lhc.Sync()
 
 	for _, hdr := range s.HeaderList {
@@ -727,7 +1194,7 @@ func TestLocalFindSector(t *testing.T) {
 
 		if segHeaders != nil {
 			for _, s := range segHeaders {
-				i64, err := strconv.ParseUint(hex.EncodeToString(s.I)[:4], 16, 64)
+				i64, err := strconv.ParseUint(hex.EncodeToString(s.IKey())[:4], 16, 64)
 				if err != nil {
 					fmt.Println("whoops:", err)
 					t.Fail()
@@ -744,7 +1211,7 @@ func TestLocalFindSector(t *testing.T) {
 						t.Fail()
 					}
 				}
-				contains := seg.Contains(s.I)
+				contains := seg.Contains(s.IKey())
 				if contains == false {
 					fmt.Printf("Error, %d outside of range [%d, %d)\n", i, start, end)
 					t.Fail()
@@ -755,7 +1222,7 @@ func TestLocalFindSector(t *testing.T) {
 				for _, h := range allHeaders {
 					var found bool = false
 
-					i64, err := strconv.ParseUint(hex.EncodeToString(h.I)[:4], 16, 64)
+					i64, err := strconv.ParseUint(hex.EncodeToString(h.IKey())[:4], 16, 64)
 					if err != nil {
 						t.Fail()
 					}
@@ -770,21 +1237,21 @@ func TestLocalFindSector(t *testing.T) {
 						}
 					}
 
-					//fmt.Printf("Seeking %04x - %s for range [%04x, %04x)\n", i, string(h.I), start, end)
+					//fmt.Printf("Seeking %04x - %s for range [%04x, %04x)\n", i, string(h.IKey()), start, end)
 
 					for _, s := range segHeaders {
-						if s.time < oneHrAgo {
+						if s.time() < oneHrAgo {
 							continue
 						}
 
-						if bytes.Equal(s.I, h.I) {
+						if bytes.Equal(s.IKey(), h.IKey()) {
 							found = true
 							break
 						}
 					}
 					if found == false {
-						if h.time > oneHrAgo {
-							fmt.Printf("Error, %04x, %s not found for range [%04x, %04x)\n", i, string(h.I), start, end)
+						if h.time() > oneHrAgo {
+							fmt.Printf("Error, %04x, %s not found for range [%04x, %04x)\n", i, string(h.IKey()), start, end)
 							t.Fail()
 						}
 					}
@@ -793,3 +1260,889 @@ func TestLocalFindSector(t *testing.T) {
 		}
 	}
 }
+
+func testKVStore(t *testing.T, kv KVStore) {
+	keys := []string{"\x02b", "\x02a", "\x03c", "\xC0a"}
+	for _, k := range keys {
+		err := kv.Put([]byte(k), []byte("v"+k))
+		if err != nil {
+			fmt.Println("Put failed:", err)
+			t.Fail()
+		}
+	}
+	v, err := kv.Get([]byte("\x02a"))
+	if err != nil || string(v) != "v\x02a" {
+		fmt.Println("Get returned wrong value")
+		t.Fail()
+	}
+	_, err = kv.Get([]byte("\x02z"))
+	if err != ErrKVNotFound {
+		fmt.Println("Get of missing key returned", err)
+		t.Fail()
+	}
+
+	batch := new(KVBatch)
+	batch.Delete([]byte("\x02b"))
+	batch.Put([]byte("\x02d"), []byte("d"))
+	err = kv.Write(batch)
+	if err != nil {
+		fmt.Println("Write failed:", err)
+		t.Fail()
+	}
+
+	expected := []string{"\x02a", "\x02d", "\x03c"}
+	iter := kv.NewIterator([]byte{0x02}, []byte{0x04})
+	found := make([]string, 0)
+	for iter.Next() {
+		found = append(found, string(iter.Key()))
+	}
+	iter.Release()
+	if iter.Error() != nil || len(found) != len(expected) {
+		fmt.Println("iterator returned", len(found), "keys, expected", len(expected))
+		t.Fail()
+		return
+	}
+	for i := range expected {
+		if found[i] != expected[i] {
+			fmt.Printf("iterator key %d = %q, expected %q\n", i, found[i], expected[i])
+			t.Fail()
+		}
+	}
+}
+
+// Generate implements quick.Generator, favoring sectors which wrap around
+func (ShardSector) Generate(r *rand.Rand, size int) reflect.Value {
+	s := ShardSector{Ring: uint(r.Intn(ShardSectorOuterRing + 1))}
+	if r.Intn(2) == 0 {
+		s.Start = ShardMaxVal - 1 - r.Intn(s.Size())
+	} else {
+		s.Start = ShardBaseVal + r.Intn(ShardNBins)
+	}
+	return reflect.ValueOf(s)
+}
+
+func sectorBins(s ShardSector) (bins map[int]bool) {
+	bins = make(map[int]bool)
+	for b := ShardBaseVal; b < ShardMaxVal; b++ {
+		if s.Contains([]byte{byte(b >> 8), byte(b)}) {
+			bins[b] = true
+		}
+	}
+	return bins
+}
+
+// sameSector compares sectors, any start describes the full circle
+func sameSector(a ShardSector, b ShardSector) bool {
+	return (a == b) || ((a.Ring == 0) && (b.Ring == 0))
+}
+
+func TestShardSector(t *testing.T) {
+	check := func(name string, f interface{}) {
+		if err := quick.Check(f, nil); err != nil {
+			fmt.Println(name, "failed:", err)
+			t.Fail()
+		}
+	}
+
+	check("Size", func(s ShardSector) bool {
+		bins := s.Bins()
+		if (len(bins) != s.Size()) || (len(sectorBins(s)) != s.Size()) {
+			return false
+		}
+		for _, b := range bins {
+			if !sectorBins(s)[b] {
+				return false
+			}
+		}
+		return true
+	})
+
+	check("String", func(s ShardSector) bool {
+		p, err := ParseShardSector(s.String())
+		return (err == nil) && (p == s)
+	})
+
+	check("Split", func(s ShardSector) bool {
+		halves := s.Split()
+		if s.Ring == ShardSectorOuterRing {
+			return (len(halves) == 1) && (halves[0] == s)
+		}
+		u := halves[0].Union(halves[1])
+		return (len(u) == 1) && sameSector(u[0], s) && !halves[0].Overlaps(halves[1])
+	})
+
+	check("Union", func(a ShardSector, b ShardSector) bool {
+		bins := sectorBins(a)
+		for bin := range sectorBins(b) {
+			bins[bin] = true
+		}
+		u := a.Union(b)
+		if u.Size() != len(bins) {
+			return false
+		}
+		for _, bin := range u.Bins() {
+			if !bins[bin] {
+				return false
+			}
+		}
+		return true
+	})
+
+	check("Intersect", func(a ShardSector, b ShardSector) bool {
+		bins := make(map[int]bool)
+		bb := sectorBins(b)
+		for bin := range sectorBins(a) {
+			if bb[bin] {
+				bins[bin] = true
+			}
+		}
+		x := a.Intersect(b)
+		if (x.Size() != len(bins)) || (a.Overlaps(b) != (len(bins) > 0)) {
+			return false
+		}
+		for _, bin := range x.Bins() {
+			if !bins[bin] {
+				return false
+			}
+		}
+		return true
+	})
+
+	check("Subtract", func(a ShardSector, b ShardSector) bool {
+		d := ShardSectorSet{a}.Subtract(ShardSectorSet{b})
+		if d.Size() != a.Size()-a.Intersect(b).Size() {
+			return false
+		}
+		return !d.Overlaps(ShardSectorSet{b}) && (d.Union(a.Intersect(b)).Size() == a.Size())
+	})
+
+	// normalized sets use the fewest sectors
+	check("Normalize", func(a ShardSector) bool {
+		ss := ShardSectorSet(a.Split()).Union(nil)
+		return (len(ss) == 1) && sameSector(ss[0], a)
+	})
+
+	ss, err := ParseShardSectorSet("3f0/5,200/5")
+	if (err != nil) || (ss.String() != "3f0/4") {
+		fmt.Println("ParseShardSectorSet returned", ss, err)
+		t.Fail()
+	}
+	for _, bad := range []string{"", "1ff/1", "400/1", "200/10", "200", "2g0/1"} {
+		_, err = ParseShardSectorSet(bad)
+		if err == nil {
+			fmt.Printf("parsed invalid sector set %q\n", bad)
+			t.Fail()
+		}
+	}
+
+	// findSector agrees with Contains, including for sectors which wrap
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir, NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+	hdrs := benchHeaders(200)
+	for i := range hdrs {
+		lhc.Insert(&hdrs[i])
+	}
+	check("findSector", func(s ShardSector) bool {
+		found, err := lhc.findSector(s)
+		if err != nil {
+			return false
+		}
+		expected := 0
+		for i := range hdrs {
+			if s.Contains(hdrs[i].I) {
+				expected += 1
+			}
+		}
+		for i := range found {
+			if !s.Contains(found[i].IKey()) {
+				return false
+			}
+		}
+		return len(found) == expected
+	})
+}
+
+func TestKVStore(t *testing.T) {
+	testKVStore(t, NewMemKVStore())
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	kv, err := OpenLevelDBStore(tmpdir + "/kvdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	testKVStore(t, kv)
+}
+
+func TestLocalHeaderCacheMemKV(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir, NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+
+	hdrs := benchHeaders(100)
+	for i := range hdrs {
+		insert, err := lhc.Insert(&hdrs[i])
+		if err != nil || !insert {
+			fmt.Println("Insert failed:", err)
+			t.Fail()
+		}
+	}
+	insert, _ := lhc.Insert(&hdrs[0])
+	if insert {
+		fmt.Println("duplicate header inserted")
+		t.Fail()
+	}
+	if lhc.Count != len(hdrs) {
+		fmt.Println("count mismatch", lhc.Count, len(hdrs))
+		t.Fail()
+	}
+	found, err := lhc.FindSince(0)
+	if err != nil || len(found) != len(hdrs) {
+		fmt.Println("FindSince returned", len(found), "headers")
+		t.Fail()
+	}
+	err = lhc.Remove(&hdrs[0])
+	if err != nil {
+		fmt.Println("Remove failed:", err)
+		t.Fail()
+	}
+	_, err = lhc.FindByI(hdrs[0].I)
+	if err == nil {
+		fmt.Println("found removed header")
+		t.Fail()
+	}
+}
+
+func TestHeaderCacheMemKV(t *testing.T) {
+	hdrs := benchHeaders(2000)
+	hlist := make([]string, len(hdrs))
+	for i := range hdrs {
+		priv, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs[i].I = priv.PubKey().SerializeCompressed()
+		hdrs[i].J = hdrs[i].I
+		hdrs[i].K = hdrs[i].I
+		hlist[i] = hdrs[i].Serialize()
+	}
+
+	// the peer requires more work than the network minimum
+	advertised := (&ScaledPoWPolicy{BaseBits: 18, BlockUnit: 64, MaxBits: 24}).Status()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+apiStatus, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(StatusResponse{PoW: advertised})
+	})
+	mux.HandleFunc("/"+apiTime, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(TimeResponse{Time: int(time.Now().Unix())})
+	})
+	mux.HandleFunc("/api/v2/headers", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(HeaderListResponse{Headers: hlist})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc, err := OpenHeaderCache(u.Hostname(), uint16(port), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hc.Close()
+	if hc.pow.Status() != advertised {
+		fmt.Println("peer cache policy", hc.pow.Status(), "expected", advertised)
+		t.Fail()
+	}
+
+	// the local policy does not apply to peer caches
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir, NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.Peers = append(lhc.Peers, &peerCache{HC: hc})
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 28})
+	if hc.pow.Status() != advertised {
+		fmt.Println("local policy applied to peer cache")
+		t.Fail()
+	}
+	lhc.Peers = nil
+
+	hc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+
+	err = hc.Sync()
+	if err != nil {
+		fmt.Println("Sync failed:", err)
+		t.Fail()
+	}
+	if hc.Count != len(hdrs) {
+		fmt.Println("synced", hc.Count, "headers, expected", len(hdrs))
+		t.Fail()
+	}
+	found, err := hc.FindSince(0)
+	if err != nil || len(found) != len(hdrs) {
+		fmt.Println("FindSince returned", len(found), "headers")
+		t.Fail()
+	}
+	count := 0
+	it := hc.IterExpiringAfter(0, 0)
+	for it.Next() {
+		count += 1
+	}
+	it.Close()
+	if count != len(hdrs) {
+		fmt.Println("IterExpiringAfter returned", count, "headers")
+		t.Fail()
+	}
+	h, err := hc.FindByI(hdrs[0].I)
+	if err != nil || !bytes.Equal(h.IKey(), hdrs[0].I) {
+		fmt.Println("FindByI failed:", err)
+		t.Fail()
+	}
+}
+
+func TestHeaderIterator(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir, NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+
+	hdrs := benchHeaders(100)
+	for i := range hdrs {
+		lhc.Insert(&hdrs[i])
+	}
+
+	// page through with a limit, resuming from the cursor
+	seen := make(map[string]bool)
+	pages := 0
+	last := uint32(0)
+	it := lhc.IterSince(0, 30)
+	for {
+		count := 0
+		for it.Next() {
+			if it.Servertime() < last {
+				fmt.Println("servertime out of order")
+				t.Fail()
+			}
+			last = it.Servertime()
+			seen[string(it.Header().IKey())] = true
+			count += 1
+		}
+		if it.Err() != nil {
+			fmt.Println("iterator error:", it.Err())
+			t.Fail()
+		}
+		cursor := it.Cursor()
+		it.Close()
+		pages += 1
+		if (count < 30) || (pages > 10) {
+			break
+		}
+		it = lhc.IterCursor(cursor, 30)
+	}
+	if (len(seen) != len(hdrs)) || (pages != 4) {
+		fmt.Println("paged", len(seen), "headers in", pages, "pages")
+		t.Fail()
+	}
+
+	it = lhc.IterExpiringAfter(0, 0)
+	count := 0
+	for it.Next() {
+		count += 1
+	}
+	it.Close()
+	if count != len(hdrs) {
+		fmt.Println("IterExpiringAfter returned", count, "headers")
+		t.Fail()
+	}
+
+	// a streamed list with a limit includes the cursor to continue from
+	buf := new(bytes.Buffer)
+	err = WriteHeaderList(buf, lhc.IterSince(0, 10), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hlr HeaderListResponse
+	if json.Unmarshal(buf.Bytes(), &hlr) != nil {
+		fmt.Println("invalid JSON:", buf.String())
+		t.Fail()
+	}
+	cursor, err := ParseHeaderCursor(hlr.Cursor)
+	if (len(hlr.Headers) != 10) || (err != nil) {
+		fmt.Println("streamed", len(hlr.Headers), "headers, cursor", hlr.Cursor)
+		t.Fail()
+	}
+	hdrs2, err := collectHeaders(lhc.IterCursor(cursor, 0))
+	if (err != nil) || (len(hdrs2) != len(hdrs)-10) {
+		fmt.Println("resumed with", len(hdrs2), "headers")
+		t.Fail()
+	}
+
+	buf.Reset()
+	WriteHeaderList(buf, lhc.IterSince(0, 0), 0)
+	hlr = HeaderListResponse{}
+	if (json.Unmarshal(buf.Bytes(), &hlr) != nil) || (len(hlr.Headers) != len(hdrs)) || (hlr.Cursor != "") {
+		fmt.Println("unlimited stream returned", len(hlr.Headers), "headers, cursor", hlr.Cursor)
+		t.Fail()
+	}
+
+	// a list cut short by an error says so
+	corrupt := append([]byte{indexPrefixServertime, 0, 0, 0, 1}, bytes.Repeat([]byte{0x02}, 33)...)
+	lhc.db.kv.Put(corrupt, []byte("corrupt"))
+	buf.Reset()
+	err = WriteHeaderList(buf, lhc.IterSince(0, 0), 0)
+	hlr = HeaderListResponse{}
+	if (err == nil) || (json.Unmarshal(buf.Bytes(), &hlr) != nil) || (hlr.Error == "") || (hlr.Cursor != "") {
+		fmt.Println("failed stream not reported:", buf.String())
+		t.Fail()
+	}
+	lhc.db.kv.Delete(corrupt)
+
+	_, err = ParseHeaderCursor("d000")
+	if err == nil {
+		fmt.Println("parsed invalid cursor")
+		t.Fail()
+	}
+	it = lhc.IterCursor(HeaderCursor{0x01}, 0)
+	if it.Next() || (it.Err() == nil) {
+		fmt.Println("iterated from invalid cursor")
+		t.Fail()
+	}
+	it.Close()
+}
+
+func TestFindByTimeRange(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir, NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+
+	hdrs := benchHeaders(100)
+	for i := range hdrs {
+		lhc.Insert(&hdrs[i])
+	}
+
+	from := uint32(time.Now().Unix()) - 2400
+	to := from + 1200
+	expected := 0
+	for _, h := range hdrs {
+		if (h.time >= from) && (h.time < to) {
+			expected += 1
+		}
+	}
+
+	found, err := lhc.FindByTimeRange(from, to)
+	if (err != nil) || (len(found) != expected) {
+		fmt.Println("FindByTimeRange returned", len(found), "headers, expected", expected)
+		t.Fail()
+	}
+	for i, h := range found {
+		if (h.time() < from) || (h.time() >= to) {
+			fmt.Println("header outside time range")
+			t.Fail()
+		}
+		if (i > 0) && (h.time() < found[i-1].time()) {
+			fmt.Println("headers not in time order")
+			t.Fail()
+		}
+	}
+
+	// resume from a cursor within the range
+	it := lhc.IterTimeRange(from, to, 1)
+	if !it.Next() {
+		fmt.Println("IterTimeRange returned no headers")
+		t.FailNow()
+	}
+	cursor := it.Cursor()
+	it.Close()
+	rest, err := collectHeaders(lhc.IterTimeRangeCursor(cursor, to, 0))
+	if (err != nil) || (len(rest) != expected-1) {
+		fmt.Println("IterTimeRangeCursor returned", len(rest), "headers")
+		t.Fail()
+	}
+	it = lhc.IterSince(0, 1)
+	it.Next()
+	cursor = it.Cursor()
+	it.Close()
+	_, err = collectHeaders(lhc.IterTimeRangeCursor(cursor, to, 0))
+	if err == nil {
+		fmt.Println("resumed time range from servertime cursor")
+		t.Fail()
+	}
+}
+
+func TestPeerStorage(t *testing.T) {
+	lhc := &LocalHeaderCache{basepath: "headers"}
+	seed := &peerCandidate{host: "seed.example.com", port: 7754}
+	inbound := &peerCandidate{host: "peer.example.com", port: 7754, inbound: true}
+
+	if lhc.peerDBPath(seed) != "headers/remote/seed.example.com_7754/hdb" {
+		fmt.Println("unexpected disk path", lhc.peerDBPath(seed))
+		t.Fail()
+	}
+	if lhc.peerDBPath(inbound) == "" {
+		fmt.Println("inbound peer in memory with disk storage")
+		t.Fail()
+	}
+	lhc.SetPeerStorage(PeerStorageInboundMemory)
+	if (lhc.peerDBPath(seed) == "") || (lhc.peerDBPath(inbound) != "") {
+		fmt.Println("inbound memory storage mismatch")
+		t.Fail()
+	}
+	lhc.SetPeerStorage(PeerStorageMemory)
+	if (lhc.peerDBPath(seed) != "") || (lhc.peerDBPath(inbound) != "") {
+		fmt.Println("memory storage mismatch")
+		t.Fail()
+	}
+}
+
+func TestRecipientIndex(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	kv := NewMemKVStore()
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+
+	hdrs := benchHeaders(64)
+	for i := range hdrs {
+		hdrs[i].J[0] = 0x02
+		hdrs[i].K[0] = 0x03
+	}
+	hdrs[1].J = append([]byte{}, hdrs[0].J...)
+
+	_, err = lhc.FindByJ(hdrs[0].J)
+	if err != ErrRecipientIndexDisabled {
+		fmt.Println("FindByJ without index returned", err)
+		t.Fail()
+	}
+
+	// index is built from existing records and maintained on insert
+	for i := 0; i < 32; i++ {
+		lhc.Insert(&hdrs[i])
+	}
+	err = lhc.EnableRecipientIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 32; i < len(hdrs); i++ {
+		lhc.Insert(&hdrs[i])
+	}
+
+	found, err := lhc.FindByJ(hdrs[0].J)
+	if err != nil || len(found) != 2 {
+		fmt.Println("FindByJ returned", len(found), "headers, expected 2")
+		t.Fail()
+	}
+	found, err = lhc.FindByK(hdrs[40].K[:4])
+	if err != nil || len(found) != 1 || !bytes.Equal(found[0].IKey(), hdrs[40].I) {
+		fmt.Println("FindByK prefix failed")
+		t.Fail()
+	}
+	found, err = lhc.FindByK([]byte{0x03})
+	if err != nil || len(found) != len(hdrs) {
+		fmt.Println("FindByK returned", len(found), "headers, expected", len(hdrs))
+		t.Fail()
+	}
+	found, err = lhc.FindByJ([]byte{0x03})
+	if err != nil || len(found) != 0 {
+		fmt.Println("FindByJ matched wrong prefix")
+		t.Fail()
+	}
+
+	lhc.Remove(&hdrs[0])
+	found, err = lhc.FindByJ(hdrs[0].J)
+	if err != nil || len(found) != 1 {
+		fmt.Println("FindByJ after remove returned", len(found), "headers, expected 1")
+		t.Fail()
+	}
+	lhc.Close()
+
+	// a complete index is not rebuilt, stale entries would survive
+	stale := append(append([]byte{indexPrefixJ}, hdrs[0].J...), bytes.Repeat([]byte{0x03}, 33)...)
+	kv.Put(stale, []byte("stale"))
+	lhc, err = OpenLocalHeaderCacheKV(tmpdir, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lhc.EnableRecipientIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv.Get(stale)
+	if err != nil {
+		fmt.Println("complete recipient index rebuilt")
+		t.Fail()
+	}
+	lhc.Close()
+
+	// writing with the index disabled forces a rebuild, skipping records
+	// which do not parse
+	lhc, err = OpenLocalHeaderCacheKV(tmpdir, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+	lhc.Insert(&hdrs[0])
+	_, err = kv.Get(recipientIndexKey)
+	if err != ErrKVNotFound {
+		fmt.Println("recipient index marker not cleared")
+		t.Fail()
+	}
+	bad := append([]byte{0x02}, make([]byte, 32)...)
+	kv.Put(bad, []byte("not a header"))
+	err = lhc.EnableRecipientIndex()
+	if err != nil {
+		fmt.Println("EnableRecipientIndex failed on bad record:", err)
+		t.Fail()
+	}
+	defer lhc.Close()
+	_, err = kv.Get(stale)
+	if err != ErrKVNotFound {
+		fmt.Println("stale recipient index entry not removed")
+		t.Fail()
+	}
+	found, err = lhc.FindByJ(hdrs[0].J)
+	if err != nil || len(found) != 2 {
+		fmt.Println("FindByJ after rebuild returned", len(found), "headers, expected 2")
+		t.Fail()
+	}
+	_, err = kv.Get(recipientIndexKey)
+	if err != nil {
+		fmt.Println("recipient index marker not set")
+		t.Fail()
+	}
+}
+
+func TestLocalHeaderCacheCheckpoint(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	kv := NewMemKVStore()
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+
+	hdrs := benchHeaders(16)
+	for i := range hdrs {
+		lhc.Insert(&hdrs[i])
+	}
+	lhc.Peers = append(lhc.Peers, &peerCache{
+		HC:           &HeaderCache{host: "peer.example.com", port: 7754},
+		lastRefresh:  0x12345678,
+		lastGetPeers: 0x23456789,
+	})
+	lhc.Close()
+
+	lhc, err = OpenLocalHeaderCacheKV(tmpdir, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+	if lhc.Count != len(hdrs) {
+		fmt.Println("checkpoint count", lhc.Count, "expected", len(hdrs))
+		t.Fail()
+	}
+
+	// crash (no Close) after updates past the last checkpoint
+	more := benchHeaders(4)
+	for i := range more {
+		lhc.Insert(&more[i])
+	}
+	lhc.checkpoint(false)
+	lhc.Remove(&hdrs[0])
+
+	lhc, err = OpenLocalHeaderCacheKV(tmpdir, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	if lhc.Count != len(hdrs)+len(more)-1 {
+		fmt.Println("count after crash", lhc.Count, "expected", len(hdrs)+len(more)-1)
+		t.Fail()
+	}
+	lastRefresh, lastGetPeers := lhc.peerState("peer.example.com", 7754)
+	if (lastRefresh != 0x12345678) || (lastGetPeers != 0x23456789) {
+		fmt.Printf("peer state %08x %08x not recovered\n", lastRefresh, lastGetPeers)
+		t.Fail()
+	}
+	lastRefresh, _ = lhc.peerState("other.example.com", 7754)
+	if lastRefresh != 0 {
+		fmt.Println("state for unknown peer")
+		t.Fail()
+	}
+}
+
+func TestPeerBook(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	kv := NewMemKVStore()
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, err := ParsePeerAddress("seed.example.com")
+	if err != nil || host != "seed.example.com" || port != DefaultPeerPort {
+		fmt.Println("ParsePeerAddress default port failed")
+		t.Fail()
+	}
+	host, port, err = ParsePeerAddress("[::1]:8080")
+	if err != nil || host != "::1" || port != 8080 {
+		fmt.Println("ParsePeerAddress ipv6 failed")
+		t.Fail()
+	}
+	_, _, err = ParsePeerAddress("seed.example.com:http")
+	if err == nil {
+		fmt.Println("ParsePeerAddress accepted invalid port")
+		t.Fail()
+	}
+	for _, a := range []string{"::1", "[::1]"} {
+		host, port, err = ParsePeerAddress(a)
+		if err != nil || host != "::1" || port != DefaultPeerPort {
+			fmt.Println("ParsePeerAddress bare ipv6 failed:", a)
+			t.Fail()
+		}
+	}
+
+	// no seeds, the only candidate is unreachable
+	lhc.SetSeedPeers([]string{})
+	lhc.AddPeerWithSource("127.0.0.1", 1, PeerSourceManual)
+	lhc.Sync()
+	if len(lhc.Peers) != 0 {
+		fmt.Println("connected without seeds")
+		t.Fail()
+	}
+	r := lhc.getPeerRecord("127.0.0.1", 1)
+	if (r == nil) || (r.Failures != 1) || (r.Source != PeerSourceManual) || (r.FirstSeen == 0) {
+		fmt.Println("failed connection not recorded")
+		t.Fail()
+	}
+
+	now := uint32(time.Now().Unix())
+	lhc.putPeerRecord(&PeerRecord{Host: "old.example.com", Port: 7754, Source: PeerSourceGossip, LastSuccess: now - 100})
+	lhc.putPeerRecord(&PeerRecord{Host: "new.example.com", Port: 7754, Source: PeerSourceSeed, LastSuccess: now - 10})
+	lhc.putPeerRecord(&PeerRecord{Host: "dead.example.com", Port: 7754, Failures: peerBookMaxFailures, LastFailure: now - peerBookRetryMax - 1})
+	lhc.peerFailure("new.example.com", 7754, PeerSourceGossip)
+	lhc.peerSuccess("new.example.com", 7754, PeerSourceGossip)
+
+	candidates := lhc.bookCandidates()
+	if (len(candidates) != 2) || (candidates[0].host != "new.example.com") || (candidates[1].host != "old.example.com") {
+		fmt.Println("unexpected book candidates:")
+		for _, c := range candidates {
+			fmt.Println(c.host, c.port)
+		}
+		t.Fail()
+	}
+	r = lhc.getPeerRecord("new.example.com", 7754)
+	if (r == nil) || (r.Source != PeerSourceSeed) || (r.Failures != 0) {
+		fmt.Println("peer record not updated")
+		t.Fail()
+	}
+	if lhc.getPeerRecord("dead.example.com", 7754) != nil {
+		fmt.Println("expired peer not dropped")
+		t.Fail()
+	}
+
+	// gossip which never connects is dropped after a few failures
+	for i := 0; i < peerBookGossipMaxFailures; i++ {
+		if i > 0 && lhc.getPeerRecord("::1", 7755) == nil {
+			fmt.Println("gossip peer dropped early")
+			t.Fail()
+		}
+		lhc.peerFailure("::1", 7755, PeerSourceGossip)
+	}
+	if lhc.getPeerRecord("::1", 7755) != nil {
+		fmt.Println("failing gossip peer not dropped")
+		t.Fail()
+	}
+
+	// the book size is limited, dropping the least recently successful
+	for i := 0; i < peerBookMaxSize; i++ {
+		lhc.putPeerRecord(&PeerRecord{Host: fmt.Sprintf("spam%d.example.com", i), Port: 7754, Source: PeerSourceGossip, FirstSeen: now - 1000})
+	}
+	lhc.bookCandidates()
+	peers, err := lhc.KnownPeers()
+	if err != nil || len(peers) != peerBookMaxSize {
+		fmt.Println("peer book has", len(peers), "entries, expected", peerBookMaxSize)
+		t.Fail()
+	}
+	if (lhc.getPeerRecord("old.example.com", 7754) == nil) || (lhc.getPeerRecord("127.0.0.1", 1) == nil) {
+		fmt.Println("wrong peers dropped from full book")
+		t.Fail()
+	}
+	lhc.Close()
+
+	// the book is persistent
+	lhc, err = OpenLocalHeaderCacheKV(tmpdir, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	peers, err = lhc.KnownPeers()
+	if err != nil || len(peers) != peerBookMaxSize {
+		fmt.Println("peer book has", len(peers), "entries after reopen, expected", peerBookMaxSize)
+		t.Fail()
+	}
+}
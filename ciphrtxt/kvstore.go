@@ -0,0 +1,215 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// KVStore is the ordered key/value store underlying the header caches and
+// the message store (see HeaderIndex). Iterators see a consistent view of
+// the store as of when they were created.
+type KVStore interface {
+	Get(key []byte) (value []byte, err error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	Write(batch *KVBatch) error
+	// NewIterator iterates over keys in [start, limit), nil limit is
+	// unbounded. The iterator must be released.
+	NewIterator(start []byte, limit []byte) KVIterator
+	Close() error
+}
+
+type KVIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+// ErrKVNotFound is returned by KVStore.Get for missing keys
+var ErrKVNotFound = errors.New("kvstore: key not found")
+
+type kvBatchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// KVBatch is a set of updates which are applied atomically by Write
+type KVBatch struct {
+	ops []kvBatchOp
+}
+
+func (b *KVBatch) Put(key []byte, value []byte) {
+	b.ops = append(b.ops, kvBatchOp{key: key, value: value})
+}
+
+func (b *KVBatch) Delete(key []byte) {
+	b.ops = append(b.ops, kvBatchOp{key: key, delete: true})
+}
+
+func (b *KVBatch) Len() int {
+	return len(b.ops)
+}
+
+// LevelDBStore is a KVStore backed by goleveldb
+type LevelDBStore struct {
+	db *leveldb.DB
+}
+
+func OpenLevelDBStore(dbpath string) (kv *LevelDBStore, err error) {
+	if len(dbpath) == 0 {
+		return nil, errors.New("refusing to open empty db path")
+	}
+	db, err := leveldb.OpenFile(dbpath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDBStore{db: db}, nil
+}
+
+func (kv *LevelDBStore) Get(key []byte) (value []byte, err error) {
+	value, err = kv.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrKVNotFound
+	}
+	return value, err
+}
+
+func (kv *LevelDBStore) Put(key []byte, value []byte) error {
+	return kv.db.Put(key, value, nil)
+}
+
+func (kv *LevelDBStore) Delete(key []byte) error {
+	return kv.db.Delete(key, nil)
+}
+
+func (kv *LevelDBStore) Write(batch *KVBatch) error {
+	lb := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.delete {
+			lb.Delete(op.key)
+		} else {
+			lb.Put(op.key, op.value)
+		}
+	}
+	return kv.db.Write(lb, nil)
+}
+
+func (kv *LevelDBStore) NewIterator(start []byte, limit []byte) KVIterator {
+	return kv.db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+}
+
+func (kv *LevelDBStore) Close() error {
+	return kv.db.Close()
+}
+
+// MemKVStore is a KVStore held entirely in memory, backed by goleveldb with
+// memory storage. Close releases the database but keeps the contents, the
+// store reopens on next use.
+type MemKVStore struct {
+	mutex sync.Mutex
+	stor  storage.Storage
+	kv    *LevelDBStore
+}
+
+func NewMemKVStore() *MemKVStore {
+	return &MemKVStore{stor: storage.NewMemStorage()}
+}
+
+func (kv *MemKVStore) open() (*LevelDBStore, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if kv.kv == nil {
+		db, err := leveldb.Open(kv.stor, nil)
+		if err != nil {
+			return nil, err
+		}
+		kv.kv = &LevelDBStore{db: db}
+	}
+	return kv.kv, nil
+}
+
+func (kv *MemKVStore) Get(key []byte) (value []byte, err error) {
+	db, err := kv.open()
+	if err != nil {
+		return nil, err
+	}
+	return db.Get(key)
+}
+
+func (kv *MemKVStore) Put(key []byte, value []byte) error {
+	db, err := kv.open()
+	if err != nil {
+		return err
+	}
+	return db.Put(key, value)
+}
+
+func (kv *MemKVStore) Delete(key []byte) error {
+	db, err := kv.open()
+	if err != nil {
+		return err
+	}
+	return db.Delete(key)
+}
+
+func (kv *MemKVStore) Write(batch *KVBatch) error {
+	db, err := kv.open()
+	if err != nil {
+		return err
+	}
+	return db.Write(batch)
+}
+
+func (kv *MemKVStore) NewIterator(start []byte, limit []byte) KVIterator {
+	db, err := kv.open()
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	return db.NewIterator(start, limit)
+}
+
+func (kv *MemKVStore) Close() error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if kv.kv == nil {
+		return nil
+	}
+	err := kv.kv.Close()
+	kv.kv = nil
+	return err
+}
@@ -28,14 +28,14 @@
 package ciphrtxt
 
 import (
+	"bytes"
 	//"net/http"
 	//"io/ioutil"
+	"encoding/binary"
 	"encoding/hex"
 	//"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	"math/rand"
 	"strconv"
 	"sync"
@@ -65,16 +65,32 @@ type peerCandidate struct {
 	host      string
 	port      uint16
 	wshandler WSProtocolHandler
+	inbound   bool
+	source    PeerSource
 }
 
+// defaultSeedPeers are used unless replaced by SetSeedPeers
 var defaultSeedPeers []*peerCandidate = []*peerCandidate{
-	&peerCandidate{"indigo.ciphrtxt.com", 7754, nil},
-	&peerCandidate{"violet.ciphrtxt.com", 7754, nil},
+	&peerCandidate{host: "indigo.ciphrtxt.com", port: 7754, source: PeerSourceSeed},
+	&peerCandidate{host: "violet.ciphrtxt.com", port: 7754, source: PeerSourceSeed},
 }
 
+// PeerStorage selects where the header caches for remote peers are kept
+type PeerStorage int
+
+const (
+	// PeerStorageDisk keeps all peer header caches on disk under remote/
+	PeerStorageDisk PeerStorage = iota
+	// PeerStorageInboundMemory keeps header caches for peers which connected
+	// to us (which are often short-lived and are not vetted) in memory
+	PeerStorageInboundMemory
+	// PeerStorageMemory keeps all peer header caches in memory
+	PeerStorageMemory
+)
+
 type LocalHeaderCache struct {
 	basepath                string
-	db                      *leveldb.DB
+	db                      *HeaderIndex
 	syncMutex               sync.Mutex
 	syncInProgress          bool
 	serverTime              uint32
@@ -83,10 +99,14 @@ type LocalHeaderCache struct {
 	Peers                   []*peerCache
 	peerCandidateMutex      sync.Mutex
 	peerCandidates          []*peerCandidate
+	seedPeers               []*peerCandidate
+	peerBookMutex           sync.Mutex
 	discoverPeersMutex      sync.Mutex
 	discoverPeersInProgress bool
 	lastPeerSync            uint32
 	ms                      *MessageStore
+	pow                     PoWPolicy
+	peerStorage             PeerStorage
 	ExternalHost            string
 	ExternalPort            int
 	ExtTokenPort            int
@@ -94,21 +114,45 @@ type LocalHeaderCache struct {
 }
 
 func OpenLocalHeaderCache(filepath string) (lhc *LocalHeaderCache, err error) {
-	lhc = new(LocalHeaderCache)
-	lhc.basepath = filepath
-
 	dbpath := filepath + "/localdb"
 
 	if len(dbpath) == 0 {
 		return nil, errors.New("refusing to open empty db path")
 	}
 
-	lhc.db, err = leveldb.OpenFile(dbpath, nil)
+	kv, err := OpenLevelDBStore(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	lhc, err = OpenLocalHeaderCacheKV(filepath, kv)
 	if err != nil {
+		kv.Close()
 		return nil, err
 	}
+	return lhc, nil
+}
+
+// OpenLocalHeaderCacheKV opens a local header cache which keeps its headers
+// in kv. Remote peer caches are still created under filepath.
+func OpenLocalHeaderCacheKV(filepath string, kv KVStore) (lhc *LocalHeaderCache, err error) {
+	lhc = new(LocalHeaderCache)
+	lhc.basepath = filepath
+	lhc.pow = DefaultPoWPolicy
+	lhc.db = NewHeaderIndex(kv, true)
+	lhc.seedPeers = defaultSeedPeers
+
+	if lhc.recoverCheckpoint() != nil {
+		err = lhc.recount()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fmt.Printf("LocalHeaderCache recovered checkpoint\n")
+	}
 
-	err = lhc.recount()
+	// mark dirty until Close
+	err = lhc.checkpoint(false)
 	if err != nil {
 		return nil, err
 	}
@@ -130,7 +174,7 @@ func (lhc *LocalHeaderCache) recount() (err error) {
 		return err
 	}
 
-	iter := lhc.db.NewIterator(&util.Range{Start: expiredBegin, Limit: expiredEnd}, nil)
+	iter := lhc.db.iter(expiredBegin, expiredEnd)
 
 	count := int(0)
 
@@ -144,7 +188,77 @@ func (lhc *LocalHeaderCache) recount() (err error) {
 	return nil
 }
 
+// checkpoint persists the header count, whether the cache was closed
+// cleanly and, for each connected peer, the peer servertime up to which
+// headers have been merged (and when the peer list was last read) so that
+// sync resumes incrementally after a restart
+func (lhc *LocalHeaderCache) checkpoint(clean bool) (err error) {
+	batch := new(KVBatch)
+
+	buf := new(bytes.Buffer)
+	if clean {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(buf, binary.BigEndian, uint64(lhc.Count))
+	binary.Write(buf, binary.BigEndian, lhc.lastPeerSync)
+	batch.Put([]byte("\000\000\000\000"), buf.Bytes()[:])
+
+	for _, p := range lhc.Peers {
+		if p.HC == nil {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, p.lastRefresh)
+		binary.Write(buf, binary.BigEndian, p.lastGetPeers)
+		batch.Put(peerStateKey(p.HC.host, p.HC.port), buf.Bytes()[:])
+	}
+	return lhc.db.write(batch)
+}
+
+// recoverCheckpoint restores the sync state and, if the cache was closed
+// cleanly, the header count. It returns an error if the count must be
+// recalculated.
+func (lhc *LocalHeaderCache) recoverCheckpoint() (err error) {
+	key := []byte("\000\000\000\000")
+	value, err := lhc.db.getMeta(key)
+	if err != nil {
+		return err
+	}
+
+	if len(value) != 13 {
+		return fmt.Errorf("checkpoint value length mismatch")
+	}
+	lhc.lastPeerSync = binary.BigEndian.Uint32(value[9:13])
+	if value[0] != 1 {
+		return fmt.Errorf("header cache was not closed cleanly")
+	}
+	lhc.Count = int(binary.BigEndian.Uint64(value[1:9]))
+	return nil
+}
+
+func peerStateKey(host string, port uint16) []byte {
+	return []byte("\000\000\000\001" + host + ":" + strconv.Itoa(int(port)))
+}
+
+// peerState returns the checkpointed sync state for a peer, zero if none
+func (lhc *LocalHeaderCache) peerState(host string, port uint16) (lastRefresh uint32, lastGetPeers uint32) {
+	value, err := lhc.db.getMeta(peerStateKey(host, port))
+	if err != nil || len(value) != 8 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint32(value[0:4]), binary.BigEndian.Uint32(value[4:8])
+}
+
 func (lhc *LocalHeaderCache) Close() {
+	if lhc.db != nil {
+		err := lhc.checkpoint(true)
+		if err != nil {
+			fmt.Printf("LocalHeaderCache:Close : checkpoint failed: %s\n", err)
+		}
+	}
+
 	for _, p := range lhc.Peers {
 		if p.HC != nil {
 			p.HC.Close()
@@ -153,7 +267,7 @@ func (lhc *LocalHeaderCache) Close() {
 	}
 
 	if lhc.db != nil {
-		lhc.db.Close()
+		lhc.db.close()
 		lhc.db = nil
 	}
 }
@@ -161,6 +275,8 @@ func (lhc *LocalHeaderCache) Close() {
 func (lhc *LocalHeaderCache) ConnectWSPeer(con iwebsocket.Connection) {
 	pc := new(peerCandidate)
 	pc.wshandler = NewWSProtocolHandler(con, lhc, nil)
+	pc.inbound = true
+	pc.source = PeerSourceInbound
 	go func(pc *peerCandidate) {
 		for tries := 30; tries > 0; tries-- {
 			pc.wshandler.RequestStatus()
@@ -181,7 +297,38 @@ func (lhc *LocalHeaderCache) ConnectWSPeer(con iwebsocket.Connection) {
 	}(pc)
 }
 
+// SetPeerStorage sets where header caches for newly added peers are kept
+func (lhc *LocalHeaderCache) SetPeerStorage(p PeerStorage) {
+	lhc.peerStorage = p
+}
+
+// peerDBPath returns the database path for the peer header cache, or "" if
+// the cache is to be held in memory
+func (lhc *LocalHeaderCache) peerDBPath(pcan *peerCandidate) string {
+	switch lhc.peerStorage {
+	case PeerStorageMemory:
+		return ""
+	case PeerStorageInboundMemory:
+		if pcan.inbound {
+			return ""
+		}
+	}
+	return lhc.basepath + "/remote/" + pcan.host + "_" + strconv.Itoa(int(pcan.port)) + "/hdb"
+}
+
+// SetPoWPolicy sets the policy used to validate headers on Insert, for the
+// local cache only. Peer caches mirror the peer and validate headers against
+// the policy the peer advertises (see PoWPolicyFromStatus).
+func (lhc *LocalHeaderCache) SetPoWPolicy(p PoWPolicy) {
+	lhc.pow = p
+}
+
 func (lhc *LocalHeaderCache) Insert(h MessageHeader) (insert bool, err error) {
+	err = CheckPoW(lhc.pow, h)
+	if err != nil {
+		return false, err
+	}
+
 	servertime := uint32(time.Now().Unix())
 
 	dbk, err := h.dbKeys(servertime)
@@ -189,20 +336,14 @@ func (lhc *LocalHeaderCache) Insert(h MessageHeader) (insert bool, err error) {
 		return false, err
 	}
 
-	_, err = lhc.db.Get(dbk.I, nil)
+	_, err = lhc.db.get(dbk.I)
 	if err == nil {
 		return false, nil
 	}
 
 	value := append([]byte(h.Serialize())[:], serializeUint32(servertime)[:]...)
 
-	batch := new(leveldb.Batch)
-	batch.Put(dbk.date, value)
-	batch.Put(dbk.servertime, value)
-	batch.Put(dbk.expire, value)
-	batch.Put(dbk.I, value)
-
-	err = lhc.db.Write(batch, nil)
+	err = lhc.db.insert(dbk, value)
 	if err != nil {
 		return false, err
 	}
@@ -222,28 +363,23 @@ func (lhc *LocalHeaderCache) Insert(h MessageHeader) (insert bool, err error) {
 }
 
 func (lhc *LocalHeaderCache) Remove(h MessageHeader) (err error) {
-	value, err := lhc.db.Get(h.IKey(), nil)
+	value, err := lhc.db.get(h.IKey())
 	if err != nil {
 		return err
 	}
-	servertime := deserializeUint32(value[MessageHeaderLengthB64V2 : MessageHeaderLengthB64V2+4])
+	servertime := deserializeUint32(value[len(value)-4:])
 	dbk, err := h.dbKeys(servertime)
 	if err != nil {
 		return err
 	}
-	batch := new(leveldb.Batch)
-	batch.Delete(dbk.date)
-	batch.Delete(dbk.servertime)
-	batch.Delete(dbk.expire)
-	batch.Delete(dbk.I)
 	lhc.Count -= 1
-	return lhc.db.Write(batch, nil)
+	return lhc.db.remove(dbk)
 }
 
 func (lhc *LocalHeaderCache) FindByI(I []byte) (h *RawMessageHeader, err error) {
 	lhc.Sync()
 
-	value, err := lhc.db.Get(I, nil)
+	value, err := lhc.db.get(I)
 	if err != nil {
 		return nil, err
 	}
@@ -254,143 +390,126 @@ func (lhc *LocalHeaderCache) FindByI(I []byte) (h *RawMessageHeader, err error)
 	return h, nil
 }
 
-func (lhc *LocalHeaderCache) FindSince(tstamp uint32) (hdrs []RawMessageHeader, err error) {
-	lhc.Sync()
+func (lhc *LocalHeaderCache) FindSince(tstamp uint32) (hdrs []CompactMessageHeader, err error) {
+	return collectHeaders(lhc.IterSince(tstamp, 0))
+}
 
-	emptyMessage := "000000000000000000000000000000000000000000000000000000000000000000"
-	tag1 := fmt.Sprintf("C0%08X%s", tstamp, emptyMessage)
-	tag2 := "C0" + "FFFFFFFF" + emptyMessage
+// IterSince iterates over headers received at or after tstamp (servertime)
+// in servertime order, stopping after limit headers if limit > 0
+func (lhc *LocalHeaderCache) IterSince(tstamp uint32, limit int) HeaderIterator {
+	lhc.Sync()
 
-	bin1, err := hex.DecodeString(tag1)
-	if err != nil {
-		return nil, err
-	}
-	bin2, err := hex.DecodeString(tag2)
-	if err != nil {
-		return nil, err
-	}
+	start, end := timeRange(indexPrefixServertime, tstamp)
+	return newHeaderIterator(lhc.db, start, end, limit)
+}
 
-	iter := lhc.db.NewIterator(&util.Range{Start: bin1, Limit: bin2}, nil)
+// IterExpiringAfter iterates over headers expiring at or after tstamp in
+// expiry order, stopping after limit headers if limit > 0
+func (lhc *LocalHeaderCache) IterExpiringAfter(tstamp uint32, limit int) HeaderIterator {
+	lhc.Sync()
 
-	hdrs = make([]RawMessageHeader, 0)
-	for iter.Next() {
-		h := new(RawMessageHeader)
-		if h.Deserialize(string(iter.Value())) != nil {
-			return nil, errors.New("error parsing message header")
-		}
-		hdrs = append(hdrs, *h)
-	}
-	return hdrs, nil
+	start, end := timeRange(indexPrefixExpire, tstamp)
+	return newHeaderIterator(lhc.db, start, end, limit)
 }
 
-func (lhc *LocalHeaderCache) findSector(seg ShardSector) (hdrs []RawMessageHeader, err error) {
-	var tag1, tag2, tag3, tag4 string
-	var bin1, bin2, bin3, bin4 []byte
+// IterCursor resumes the iteration (IterSince or IterExpiringAfter) which
+// returned the cursor c
+func (lhc *LocalHeaderCache) IterCursor(c HeaderCursor, limit int) HeaderIterator {
+	lhc.Sync()
+
+	return newHeaderCursorIterator(lhc.db, c, limit)
+}
 
-	start := seg.Start
-	ring := seg.Ring
+// FindByTimeRange returns the headers with message time in [from, to) in
+// message time order
+func (lhc *LocalHeaderCache) FindByTimeRange(from uint32, to uint32) (hdrs []CompactMessageHeader, err error) {
+	return collectHeaders(lhc.IterTimeRange(from, to, 0))
+}
 
+// IterTimeRange iterates over headers with message time in [from, to),
+// stopping after limit headers if limit > 0
+func (lhc *LocalHeaderCache) IterTimeRange(from uint32, to uint32, limit int) HeaderIterator {
 	lhc.Sync()
 
-	//fmt.Printf("LocalHeaderCache.findSector %04x, %d\n", start, ring)
-
-	if (start < 0x0200) || (start > 0x03ff) {
-		return nil, fmt.Errorf("LocalHeaderCache.findSector start value out of range")
-	}
+	start, end := dateRange(from, to)
+	return newHeaderIterator(lhc.db, start, end, limit)
+}
 
-	if (ring < 0) || (ring > 9) {
-		return nil, fmt.Errorf("LocalHeaderCache.findSector ring value out of range")
-	}
+// IterTimeRangeCursor resumes the IterTimeRange which returned the cursor c
+func (lhc *LocalHeaderCache) IterTimeRangeCursor(c HeaderCursor, to uint32, limit int) HeaderIterator {
+	lhc.Sync()
 
-	ringsz := 512 >> ring
-	end := start + ringsz
+	return newHeaderDateCursorIterator(lhc.db, c, to, limit)
+}
 
-	emptyMessage := "00000000000000000000000000000000000000000000000000000000000000"
-	tag1 = fmt.Sprintf("%04X%s", start, emptyMessage)
+func (lhc *LocalHeaderCache) findSector(seg ShardSector) (hdrs []CompactMessageHeader, err error) {
+	lhc.Sync()
 
-	if end > 0x400 {
-		tag2 = fmt.Sprintf("0400%s", emptyMessage)
-		tag3 = fmt.Sprintf("0000%s", emptyMessage)
-		tag4 = fmt.Sprintf("%04X%s", ((end & 0x03FF) | (0x0200)), emptyMessage)
+	//fmt.Printf("LocalHeaderCache.findSector %s\n", seg)
 
-		//fmt.Printf("fs: tag1 = %s\n", tag1)
-		//fmt.Printf("fs: tag2 = %s\n", tag2)
-		//fmt.Printf("fs: tag3 = %s\n", tag3)
-		//fmt.Printf("fs: tag4 = %s\n", tag4)
+	if !seg.Valid() {
+		return nil, fmt.Errorf("LocalHeaderCache.findSector sector %s out of range", seg)
+	}
 
-		bin3, err = hex.DecodeString(tag3)
-		if err != nil {
-			return nil, err
-		}
-		bin4, err = hex.DecodeString(tag4)
+	// records are keyed by I, which begins with the bin
+	hdrs = make([]CompactMessageHeader, 0)
+	for _, span := range seg.spans() {
+		begin := make([]byte, 2)
+		end := make([]byte, 2)
+		binary.BigEndian.PutUint16(begin, uint16(span[0]))
+		binary.BigEndian.PutUint16(end, uint16(span[1]))
+		found, err := collectHeaders(newHeaderIterator(lhc.db, begin, end, 0))
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		tag2 = fmt.Sprintf("%04X%s", end, emptyMessage)
-
-		//fmt.Printf("fs: tag1 = %s\n", tag1)
-		//fmt.Printf("fs: tag2 = %s\n", tag2)
-	}
-
-	bin1, err = hex.DecodeString(tag1)
-	if err != nil {
-		return nil, err
-	}
-	bin2, err = hex.DecodeString(tag2)
-	if err != nil {
-		return nil, err
+		hdrs = append(hdrs, found...)
 	}
 
-	iter := lhc.db.NewIterator(&util.Range{Start: bin1, Limit: bin2}, nil)
-
-	hdrs = make([]RawMessageHeader, 0)
-	for iter.Next() {
-		h := new(RawMessageHeader)
-		if h.Deserialize(string(iter.Value())) != nil {
-			return nil, errors.New("error parsing message")
-		}
-		hdrs = append(hdrs, *h)
-	}
+	//fmt.Printf("found %d headers\n", len(hdrs))
+	return hdrs, nil
+}
 
-	if end > 0x400 {
-		iter := lhc.db.NewIterator(&util.Range{Start: bin3, Limit: bin4}, nil)
+func (lhc *LocalHeaderCache) FindExpiringAfter(tstamp uint32) (hdrs []CompactMessageHeader, err error) {
+	return collectHeaders(lhc.IterExpiringAfter(tstamp, 0))
+}
 
-		for iter.Next() {
-			h := new(RawMessageHeader)
-			if h.Deserialize(string(iter.Value())) != nil {
-				return nil, errors.New("error parsing message header")
-			}
-			hdrs = append(hdrs, *h)
+// EnableRecipientIndex builds and maintains the J and K indexes used by
+// FindByJ and FindByK
+func (lhc *LocalHeaderCache) EnableRecipientIndex() (err error) {
+	return lhc.db.enableRecipient(func(value []byte) (*dbkeys, error) {
+		h := new(CompactMessageHeader)
+		if h.Deserialize(string(value[0:len(value)-4])) != nil {
+			return nil, errors.New("error parsing message header")
 		}
-	}
-
-	//fmt.Printf("found %d headers\n", len(hdrs))
-	return hdrs, nil
+		return h.dbKeys(deserializeUint32(value[len(value)-4:]))
+	})
 }
 
-func (lhc *LocalHeaderCache) FindExpiringAfter(tstamp uint32) (hdrs []RawMessageHeader, err error) {
-	lhc.Sync()
+// FindByJ returns the headers with J beginning with prefix (compressed
+// point, i.e. 02 or 03 || x)
+func (lhc *LocalHeaderCache) FindByJ(prefix []byte) (hdrs []CompactMessageHeader, err error) {
+	return lhc.findRecipient(indexPrefixJ, prefix)
+}
 
-	emptyMessage := "000000000000000000000000000000000000000000000000000000000000000000"
-	tag1 := fmt.Sprintf("E0%08X%s", tstamp, emptyMessage)
-	tag2 := "E0" + "FFFFFFFF" + emptyMessage
+// FindByK returns the headers with K beginning with prefix
+func (lhc *LocalHeaderCache) FindByK(prefix []byte) (hdrs []CompactMessageHeader, err error) {
+	return lhc.findRecipient(indexPrefixK, prefix)
+}
 
-	bin1, err := hex.DecodeString(tag1)
-	if err != nil {
-		return nil, err
-	}
-	bin2, err := hex.DecodeString(tag2)
-	if err != nil {
-		return nil, err
+func (lhc *LocalHeaderCache) findRecipient(index byte, prefix []byte) (hdrs []CompactMessageHeader, err error) {
+	if !lhc.db.recipient {
+		return nil, ErrRecipientIndexDisabled
 	}
+	lhc.Sync()
 
-	iter := lhc.db.NewIterator(&util.Range{Start: bin1, Limit: bin2}, nil)
+	iter := lhc.db.iterPrefix(index, prefix)
+	defer iter.Release()
 
-	hdrs = make([]RawMessageHeader, 0)
+	hdrs = make([]CompactMessageHeader, 0)
 	for iter.Next() {
-		h := new(RawMessageHeader)
-		if h.Deserialize(string(iter.Value())) != nil {
+		h := new(CompactMessageHeader)
+		value := iter.Value()
+		if h.Deserialize(string(value[0:len(value)-4])) != nil {
 			return nil, errors.New("error parsing message header")
 		}
 		hdrs = append(hdrs, *h)
@@ -415,8 +534,8 @@ func (lhc *LocalHeaderCache) pruneExpired() (err error) {
 		return err
 	}
 
-	iter := lhc.db.NewIterator(&util.Range{Start: expiredBegin, Limit: expiredEnd}, nil)
-	batch := new(leveldb.Batch)
+	iter := lhc.db.iter(expiredBegin, expiredEnd)
+	batch := new(KVBatch)
 	hdr := new(RawMessageHeader)
 
 	delCount := int(0)
@@ -435,15 +554,12 @@ func (lhc *LocalHeaderCache) pruneExpired() (err error) {
 			fmt.Printf("LHC: failed to generate dbkeys\n")
 			continue
 		}
-		batch.Delete(dbk.date)
-		batch.Delete(dbk.servertime)
-		batch.Delete(dbk.expire)
-		batch.Delete(dbk.I)
+		lhc.db.batchRemove(batch, dbk)
 		delCount += 1
 	}
 	iter.Release()
 
-	err = lhc.db.Write(batch, nil)
+	err = lhc.db.write(batch)
 	if err == nil {
 		lhc.Count -= delCount
 		//fmt.Printf("LocalHeaderCache: dropping %d message headers\n", delCount)
@@ -475,12 +591,8 @@ func (lhc *LocalHeaderCache) Sync() (err error) {
 	//copy and reset candidates list
 	lhc.peerCandidateMutex.Lock()
 	candidates := lhc.peerCandidates
-	if len(candidates) == 0 {
-		candidates = make([]*peerCandidate, len(defaultSeedPeers))
-		copy(candidates, defaultSeedPeers)
-	}
-	lhc.peerCandidates = make([]*peerCandidate, len(defaultSeedPeers))
-	copy(lhc.peerCandidates, defaultSeedPeers)
+	seeds := lhc.seedPeers
+	lhc.peerCandidates = make([]*peerCandidate, 0)
 	lhc.peerCandidateMutex.Unlock()
 
 	for _, pc := range candidates {
@@ -490,6 +602,21 @@ func (lhc *LocalHeaderCache) Sync() (err error) {
 		// }
 	}
 
+	// bootstrap from the peer book, then fall back to the seeds
+	if len(lhc.Peers) < lhcTargetPeers {
+		for i, pc := range lhc.bookCandidates() {
+			if (len(lhc.Peers) >= lhcTargetPeers) || (i >= peerBookMaxAttempts) {
+				break
+			}
+			lhc.addPeer(pc)
+		}
+	}
+	if len(lhc.Peers) == 0 {
+		for _, pc := range seeds {
+			lhc.addPeer(pc)
+		}
+	}
+
 	err = lhc.pruneExpired()
 	if err != nil {
 		return err
@@ -525,7 +652,8 @@ func (lhc *LocalHeaderCache) Sync() (err error) {
 			for _, mh := range mhdrs {
 				insert, err := lhc.Insert(&mh)
 				if err != nil {
-					return err
+					fmt.Printf("lhc.Insert failed: %s\n", err)
+					continue
 				}
 				if insert {
 					insCount += 1
@@ -549,6 +677,7 @@ func (lhc *LocalHeaderCache) Sync() (err error) {
 			}
 		} else {
 			fmt.Printf("LocalHeaderCache: dropping peer %s (error count too high)\n", p.HC.baseurl)
+			lhc.peerFailure(p.HC.host, p.HC.port, PeerSourceUnknown)
 			p.HC.Close()
 		}
 	}
@@ -559,6 +688,11 @@ func (lhc *LocalHeaderCache) Sync() (err error) {
 
 	lhc.Count += insCount
 
+	err = lhc.checkpoint(false)
+	if err != nil {
+		fmt.Printf("LocalHeaderCache: checkpoint failed: %s\n", err)
+	}
+
 	//fmt.Printf("LocalHeaderCache: insert %d message headers\n", insCount)
 
 	//fmt.Printf("LocalHeaderCache: %d active message headers\n", lhc.Count)
@@ -566,13 +700,21 @@ func (lhc *LocalHeaderCache) Sync() (err error) {
 	return nil
 }
 
+// AddPeer submits a peer learned from another peer for connection
 func (lhc *LocalHeaderCache) AddPeer(host string, port uint16) {
+	lhc.AddPeerWithSource(host, port, PeerSourceGossip)
+}
+
+// AddPeerWithSource submits a peer for connection, source is recorded in
+// the peer book
+func (lhc *LocalHeaderCache) AddPeerWithSource(host string, port uint16, source PeerSource) {
 	lhc.peerCandidateMutex.Lock()
 	defer lhc.peerCandidateMutex.Unlock()
 
 	pc := new(peerCandidate)
 	pc.host = host
 	pc.port = port
+	pc.source = source
 
 	lhc.peerCandidates = append(lhc.peerCandidates, pc)
 }
@@ -608,25 +750,33 @@ func (lhc *LocalHeaderCache) addPeer(pcan *peerCandidate) (err error) {
 		}
 	}
 
-	dbpath := lhc.basepath + "/remote/" + host + "_" + strconv.Itoa(int(port)) + "/hdb"
+	dbpath := lhc.peerDBPath(pcan)
 
 	pc := new(peerCache)
 
 	rhc, err := OpenHeaderCache(host, port, dbpath)
 	if err != nil {
 		fmt.Printf("addPeer: %s:%d open header cache failed\n", host, port)
+		lhc.peerFailure(host, port, pcan.source)
 		return err
 	}
 
 	err = rhc.Sync()
 	if err != nil {
 		fmt.Printf("addPeer: %s:%d sync error\n", host, port)
+		lhc.peerFailure(host, port, pcan.source)
+		rhc.Close()
 		return err
 	}
 
+	lhc.peerSuccess(host, port, pcan.source)
+
 	lastRefresh := rhc.lastRefreshServer
 
-	mhdrs, err := rhc.FindSince(0)
+	// resume from the checkpointed state for a known peer
+	since, lastGetPeers := lhc.peerState(host, port)
+
+	mhdrs, err := rhc.FindSince(since)
 	if err != nil {
 		fmt.Printf("addPeer: %s:%d Error finding all headers\n", host, port)
 		return err
@@ -634,6 +784,7 @@ func (lhc *LocalHeaderCache) addPeer(pcan *peerCandidate) (err error) {
 
 	pc.HC = rhc
 	pc.lastRefresh = lastRefresh
+	pc.lastGetPeers = lastGetPeers
 
 	pc.wshandler = pcan.wshandler
 	pc.watchdogExpired = false
@@ -665,7 +816,7 @@ func (lhc *LocalHeaderCache) addPeer(pcan *peerCandidate) (err error) {
 
 	lhc.Peers = append(lhc.Peers, pc)
 
-	go func(lhc *LocalHeaderCache, mhdrs []RawMessageHeader) {
+	go func(lhc *LocalHeaderCache, mhdrs []CompactMessageHeader) {
 		for _, mh := range mhdrs {
 			_, err := lhc.Insert(&mh)
 			if err != nil {
@@ -807,7 +958,7 @@ func (lhc *LocalHeaderCache) Status() (status *StatusResponse) {
 	r_storage := StatusStorageResponse{
 		Headers:     lhc.Count,
 		Messages:    0,
-		Maxfilesize: (8 * 1024 * 1024),
+		Maxfilesize: MaxMessageFileSize,
 		Capacity:    (256 * 1024 * 1024 * 1024),
 		Used:        0,
 	}
@@ -826,6 +977,7 @@ func (lhc *LocalHeaderCache) Status() (status *StatusResponse) {
 	r_status := StatusResponse{
 		Network: r_network,
 		Pubkey:  lhc.PubKey,
+		PoW:     lhc.pow.Status(),
 		Storage: r_storage,
 		Sector:  r_sector,
 		Version: "0.2.0",
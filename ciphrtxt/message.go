@@ -29,14 +29,17 @@ package ciphrtxt
 
 import (
 	"bytes"
+	"crypto/sha256"
 	//"encoding/base64"
-	//"encoding/hex"
 	"encoding/binary"
-	//"fmt"
-	//"io/ioutil"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	//"strconv"
-	//"strings"
+	"strings"
 	"time"
 )
 
@@ -45,55 +48,272 @@ type MessageFile struct {
 	Size       uint64
 	Servertime uint32
 	Filepath   string
+	Digest     []byte
+	verified   bool
+}
+
+// DigestError is returned when a message file no longer matches the content
+// digest recorded when it was ingested
+type DigestError struct {
+	I []byte
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("message %s content digest mismatch", hex.EncodeToString(e.I))
 }
 
 type MessageFileSlice []MessageFile
 
-func Ingest(filepath string) *MessageFile {
+func Ingest(filepath string) (z *MessageFile, err error) {
 	f, err := os.Open(filepath)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer f.Close()
 
 	finfo, err := f.Stat()
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	// read header
-	smh := make([]byte, MessageHeaderLengthB64V2)
-	hlen, err := f.Read(smh)
+	smh, err := readHeader(f)
 	if err != nil {
-		return nil
-	}
-	if hlen != MessageHeaderLengthB64V2 {
-		return nil
+		return nil, err
 	}
 
-	z := new(MessageFile)
+	z = new(MessageFile)
 
 	// parse message header
-	if z.RawMessageHeader.Deserialize(string(smh)) != nil {
-		return nil
+	err = z.RawMessageHeader.DeserializeStrict(string(smh))
+	if err != nil {
+		return nil, err
 	}
 
-	// validate header hash
-	hh := z.RawMessageHeader.Hash()
-	if (hh[0] != 0) || (hh[1] != 0) {
-		return nil
+	// validate header hash against network minimum
+	err = CheckPoW(DefaultPoWPolicy, &z.RawMessageHeader)
+	if err != nil {
+		return nil, err
 	}
 
-	// check that file size is = blocklen + 1 blocks
-	if (int64(z.blocklen+1) * MessageHeaderLengthB64V2) != finfo.Size() {
-		return nil
+	// check that file size is = blocklen + header blocks
+	if z.fileSize() != finfo.Size() {
+		return nil, errors.New("message file size does not match header")
 	}
 
+	// check the signature and calculate the content digest in one pass. A
+	// signature failure is recorded (verified is false) rather than returned
+	// (see MessageStore.SetRequireSignatures)
+	d := sha256.New()
+	d.Write(smh)
+	body := io.TeeReader(f, d)
+	err = z.RawMessageHeader.Verify(body)
+	if _, ok := err.(*SignatureError); (err != nil) && !ok {
+		return nil, err
+	}
+	z.verified = err == nil
+	_, err = io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return nil, err
+	}
+	z.Digest = d.Sum(nil)
+
 	z.Filepath = filepath
 	z.Size = uint64(finfo.Size())
 	z.Servertime = uint32(time.Now().Unix())
 
-	return z
+	return z, nil
+}
+
+// MaxMessageFileSize is the largest message file (header + body) accepted
+const MaxMessageFileSize = (8 * 1024 * 1024)
+
+// ErrMessageTooLarge is returned by IngestReader when the message size
+// declared in the header exceeds the limit
+var ErrMessageTooLarge = errors.New("message exceeds maximum size")
+
+// ErrMessageExpired is returned by IngestReader for messages which have
+// already expired
+var ErrMessageExpired = errors.New("message expired")
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// IngestReader reads a message from r into a new file in tmpdir. The header
+// is read and validated (format, proof of work against policy p, expiry and
+// declared size against maxSize) before anything is written, so a bad upload is rejected
+// without storing the body. The body is then streamed to disk and must match
+// the size declared in the header. A signature failure is recorded, as for
+// Ingest, and left to MessageStore.Insert. On error the partial file is
+// removed.
+func IngestReader(r io.Reader, p PoWPolicy, maxSize int64, tmpdir string) (z *MessageFile, err error) {
+	smh, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	z = new(MessageFile)
+
+	err = z.RawMessageHeader.DeserializeStrict(string(smh))
+	if err != nil {
+		return nil, err
+	}
+
+	err = CheckPoW(p, &z.RawMessageHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	if z.expire <= uint32(time.Now().Unix()) {
+		return nil, ErrMessageExpired
+	}
+
+	if (maxSize > 0) && (z.fileSize() > maxSize) {
+		return nil, ErrMessageTooLarge
+	}
+
+	f, err := ioutil.TempFile(tmpdir, "ingest")
+	if err != nil {
+		return nil, err
+	}
+	tmppath := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmppath)
+		}
+	}()
+
+	_, err = f.Write(smh)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// stream body to disk while hashing it for the signature check
+	bodylen := z.fileSize() - int64(len(smh))
+	cw := &countingWriter{w: f}
+	d := sha256.New()
+	d.Write(smh)
+	body := io.TeeReader(io.LimitReader(r, bodylen), io.MultiWriter(cw, d))
+	verr := z.RawMessageHeader.Verify(body)
+	z.verified = verr == nil
+	if _, ok := verr.(*SignatureError); ok {
+		verr = nil
+	}
+	if verr == nil {
+		_, verr = io.Copy(ioutil.Discard, body)
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if cw.n != bodylen {
+		err = errors.New("message body shorter than declared size")
+		return nil, err
+	}
+	// a Read may return no data without error, so read until a byte or EOF
+	n, _ := io.CopyN(ioutil.Discard, r, 1)
+	if n != 0 {
+		err = errors.New("message body exceeds declared size")
+		return nil, err
+	}
+	if verr != nil {
+		err = verr
+		return nil, err
+	}
+
+	z.Filepath = tmppath
+	z.Digest = d.Sum(nil)
+	z.Size = uint64(z.fileSize())
+	z.Servertime = uint32(time.Now().Unix())
+
+	return z, nil
+}
+
+// Verify validates the message signature against the message file contents
+func (z *MessageFile) Verify() (err error) {
+	f, err := os.Open(z.Filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(int64(z.serializedLength()), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = z.RawMessageHeader.Verify(f)
+	if err != nil {
+		return err
+	}
+	z.verified = true
+	return nil
+}
+
+// readHeader reads the serialized header from the start of a message file.
+// V3 headers may span multiple blocks, the length of which is determined from
+// the first block.
+func readHeader(r io.Reader) (smh []byte, err error) {
+	smh = make([]byte, MessageHeaderLengthB64V2)
+	_, err = io.ReadFull(r, smh)
+	if err != nil {
+		return nil, errors.New("message header too short")
+	}
+	if !strings.HasPrefix(string(smh), "TQMA") {
+		return smh, nil
+	}
+	hlen, err := serializedLengthV3(string(smh))
+	if err != nil {
+		return nil, err
+	}
+	if hlen > MessageHeaderLengthB64V2 {
+		ext := make([]byte, hlen-MessageHeaderLengthB64V2)
+		_, err = io.ReadFull(r, ext)
+		if err != nil {
+			return nil, errors.New("message header too short")
+		}
+		smh = append(smh, ext...)
+	}
+	return smh, nil
+}
+
+// fileSize returns the expected message file size (header + body)
+func (z *MessageFile) fileSize() int64 {
+	return int64(z.blocklen)*MessageHeaderLengthB64V2 + int64(z.serializedLength())
+}
+
+// CheckDigest validates the message file contents against the digest
+// recorded at Ingest. Records created before digests were stored are only
+// checked for a missing file.
+func (z *MessageFile) CheckDigest() (err error) {
+	if len(z.Digest) == 0 {
+		_, err = os.Stat(z.Filepath)
+		return err
+	}
+	f, err := os.Open(z.Filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d := sha256.New()
+	_, err = io.Copy(d, f)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(d.Sum(nil), z.Digest) {
+		return &DigestError{I: z.I}
+	}
+	return nil
 }
 
 func (z *MessageFile) Move(filepath string) error {
@@ -107,12 +327,13 @@ func (z *MessageFile) Move(filepath string) error {
 
 func (z *MessageFile) Serialize() []byte {
 	buf := new(bytes.Buffer)
-	header := z.RawMessageHeader.ExportBinaryHeaderV2()
+	header := z.RawMessageHeader.exportBinaryHeader()
 	buf.Write(header[:])
 	binary.Write(buf, binary.BigEndian, z.Size)
 	binary.Write(buf, binary.BigEndian, z.Servertime)
 	binary.Write(buf, binary.BigEndian, int32(len(z.Filepath)))
 	buf.WriteString(z.Filepath)
+	buf.Write(z.Digest)
 	bmh := make([]byte, buf.Len())
 	copy(bmh[:], buf.Bytes()[:])
 	return bmh
@@ -122,18 +343,28 @@ func (z *MessageFile) Deserialize(bmh []byte) *MessageFile {
 	if len(bmh) < (MessageHeaderLengthV2 + 16) {
 		return nil
 	}
-	if z.RawMessageHeader.importBinaryHeaderV2(bmh) != nil {
+	if z.RawMessageHeader.importBinaryHeader(bmh) != nil {
 		return nil
 	}
-	z.Size = binary.BigEndian.Uint64(bmh[MessageHeaderLengthV2 : MessageHeaderLengthV2+8])
-	z.Servertime = binary.BigEndian.Uint32(bmh[MessageHeaderLengthV2+8 : MessageHeaderLengthV2+12])
-	lenfilepath := binary.BigEndian.Uint32(bmh[MessageHeaderLengthV2+12 : MessageHeaderLengthV2+16])
-	if len(bmh) < (MessageHeaderLengthV2 + 16 + int(lenfilepath)) {
+	hlen := z.RawMessageHeader.binaryLength()
+	if len(bmh) < (hlen + 16) {
+		return nil
+	}
+	z.Size = binary.BigEndian.Uint64(bmh[hlen : hlen+8])
+	z.Servertime = binary.BigEndian.Uint32(bmh[hlen+8 : hlen+12])
+	lenfilepath := binary.BigEndian.Uint32(bmh[hlen+12 : hlen+16])
+	if len(bmh) < (hlen + 16 + int(lenfilepath)) {
 		return nil
 	}
 	fpath := make([]byte, lenfilepath)
-	copy(fpath[:], bmh[MessageHeaderLengthV2+16:MessageHeaderLengthV2+16+lenfilepath])
+	copy(fpath[:], bmh[hlen+16:hlen+16+int(lenfilepath)])
 	z.Filepath = string(fpath)
+	// digest is not present in records written by earlier versions
+	z.Digest = nil
+	if len(bmh) >= (hlen + 16 + int(lenfilepath) + sha256.Size) {
+		z.Digest = make([]byte, sha256.Size)
+		copy(z.Digest, bmh[hlen+16+int(lenfilepath):])
+	}
 	return z
 }
 
@@ -162,8 +393,5 @@ func (z MessageFileSlice) Less(i, j int) bool {
 }
 
 func (z MessageFileSlice) Swap(i, j int) {
-	t1 := z[i].Serialize()
-	t2 := z[j].Serialize()
-	z[j].Deserialize(t1)
-	z[i].Deserialize(t2)
+	z[i], z[j] = z[j], z[i]
 }
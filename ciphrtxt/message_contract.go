@@ -0,0 +1,213 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// When SetTargets shrinks coverage the messages outside the new targets are
+// evicted, but only after a grace period so that peers covering those
+// sectors can fetch them first. Eviction is rate limited so that it doesn't
+// compete with serving and syncing. The targets, and the start of a pending
+// contraction, are kept in the database so that a restart neither loses nor
+// restarts the grace period.
+
+// DefaultContractionGrace is how long messages outside new targets are kept
+const DefaultContractionGrace = time.Hour
+
+// DefaultContractionRate is the rate of contraction eviction, in messages
+// per second
+const DefaultContractionRate = 16
+
+var (
+	targetsKey  = []byte("\000\000\000\004")
+	contractKey = []byte("\000\000\000\005")
+)
+
+// SetContraction enables eviction of messages outside the targets when
+// SetTargets shrinks coverage, after grace at up to rate messages per
+// second. Contraction is disabled if rate is 0 (the default), in which case
+// messages outside the targets are kept until they expire.
+func (ms *MessageStore) SetContraction(grace time.Duration, rate int) {
+	ms.sectorMutex.Lock()
+	defer ms.sectorMutex.Unlock()
+	ms.contractGrace = grace
+	ms.contractRate = rate
+}
+
+// StoredTargets returns the targets last set for the store, including by a
+// previous process, or nil if targets have never been set
+func (ms *MessageStore) StoredTargets() ShardSectorSet {
+	value, err := ms.db.getMeta(targetsKey)
+	if err != nil {
+		return nil
+	}
+	targets, err := ParseShardSectorSet(string(value))
+	if err != nil {
+		return nil
+	}
+	return targets
+}
+
+// startContraction begins (or resumes) evicting messages outside targets if
+// they do not cover the previous targets
+func (ms *MessageStore) startContraction(previous ShardSectorSet, targets ShardSectorSet, gen int) {
+	ms.sectorMutex.Lock()
+	rate := ms.contractRate
+	ms.sectorMutex.Unlock()
+	if rate <= 0 {
+		return
+	}
+
+	since := uint32(0)
+	value, err := ms.db.getMeta(contractKey)
+	if err == nil && len(value) == 4 {
+		since = deserializeUint32(value)
+	}
+	if len(previous.Subtract(targets)) > 0 {
+		since = uint32(time.Now().Unix())
+		err = ms.db.putMeta(contractKey, serializeUint32(since))
+		if err != nil {
+			fmt.Printf("MS: failed to record contraction: %s\n", err)
+			return
+		}
+	}
+	if since == 0 {
+		return
+	}
+
+	ms.syncwg.Add(1)
+	go ms.contract(gen, since)
+}
+
+// contract evicts messages outside the targets set by generation gen once
+// the grace period from since has passed. A later SetTargets stops it.
+func (ms *MessageStore) contract(gen int, since uint32) {
+	defer ms.syncwg.Done()
+
+	ms.sectorMutex.Lock()
+	grace := ms.contractGrace
+	rate := ms.contractRate
+	ms.sectorMutex.Unlock()
+
+	wait := time.Unix(int64(since), 0).Add(grace).Sub(time.Now())
+	if wait > 0 {
+		fmt.Printf("MS: contracting to %s in %s\n", ms.GetCurrentTargets(), wait)
+		select {
+		case <-time.After(wait):
+		case <-ms.done:
+			return
+		}
+	}
+
+	var after []byte
+	total := 0
+	for {
+		n, next, err := ms.contractBatch(gen, after, rate)
+		total += n
+		if err != nil {
+			fmt.Printf("MS: contraction failed: %s\n", err)
+			return
+		}
+		if next == nil {
+			break
+		}
+		after = next
+		select {
+		case <-time.After(time.Second):
+		case <-ms.done:
+			return
+		}
+	}
+
+	ms.sectorMutex.Lock()
+	current := ms.targetGen == gen
+	ms.sectorMutex.Unlock()
+	if current {
+		ms.db.deleteMeta(contractKey)
+		fmt.Printf("MS: contraction evicted %d messages\n", total)
+	}
+}
+
+// contractBatch evicts up to limit messages outside the targets, beginning
+// after the record with I after. It returns the last I examined, or nil
+// when there are no more records or the targets have changed.
+func (ms *MessageStore) contractBatch(gen int, after []byte, limit int) (n int, next []byte, err error) {
+	ms.sectorMutex.Lock()
+	targets := ms.targets
+	current := ms.targetGen == gen
+	ms.sectorMutex.Unlock()
+	if !current {
+		return 0, nil, nil
+	}
+
+	start := []byte{0x02}
+	if after != nil {
+		start = append(append([]byte{}, after...), 0x00)
+	}
+
+	// collect first, Remove modifies the database
+	iter := ms.db.iter(start, []byte{0x04})
+	msgs := make([]*MessageFile, 0, limit)
+	for iter.Next() {
+		next = append(next[:0], iter.Key()...)
+		m := new(MessageFile)
+		if m.Deserialize(iter.Value()) == nil {
+			continue
+		}
+		if targets.Contains(m.I) {
+			continue
+		}
+		msgs = append(msgs, m)
+		if len(msgs) >= limit {
+			break
+		}
+	}
+	more := len(msgs) >= limit
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, m := range msgs {
+		err = ms.Remove(m)
+		if err != nil {
+			fmt.Printf("MS: contraction evict %s failed: %s\n", hex.EncodeToString(m.I), err)
+			continue
+		}
+		n += 1
+	}
+	if !more {
+		return n, nil, nil
+	}
+	return n, next, nil
+}
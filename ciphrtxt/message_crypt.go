@@ -0,0 +1,342 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/jadeblaquiere/cttd/btcec"
+)
+
+// Message keys are derived from an ephemeral ECDH exchange with the recipient
+// public key P (private key p):
+//
+// I = e * G                    (e random, ephemeral key / message ID)
+// S = e * P = p * I            (shared secret point, compressed)
+// J = SHA256("J" || S) * G     (recipient tag)
+// K = SHA256("K" || S) * G     (signing key, see RawMessageHeader.Verify)
+//
+// The payload (32-bit plaintext length || plaintext || zero padding to a
+// multiple of 192 bytes) is encrypted with AES-256-CTR using the key
+// SHA256("E" || S) and the IV SHA256(I)[:16]. The message body is the base64
+// encoding of the ciphertext, which is an integral number of 256 byte blocks.
+//
+// This scheme is specific to this package. It has not been checked against
+// the ECIES scheme of the reference client (no known-answer vectors from it
+// are available here), so messages composed with NewMessage can only be
+// read with DecryptMessage and other clients may not accept them.
+
+// MessageBlockLength is the size in bytes of a decoded (binary) message block
+const MessageBlockLength = 192
+
+// Message is a composed (encrypted, signed and mined) message which has not
+// yet been written to the message store
+type Message struct {
+	RawMessageHeader
+	body []byte
+}
+
+type messageKeys struct {
+	S []byte
+	j []byte
+	J []byte
+	k *btcec.PrivateKey
+	K []byte
+	E []byte
+}
+
+func deriveScalar(tag string, S []byte) []byte {
+	curve := btcec.S256()
+	h := sha256.New()
+	h.Write([]byte(tag))
+	h.Write(S)
+	d := new(big.Int).SetBytes(h.Sum(nil))
+	d.Mod(d, curve.N)
+	return padbytes(d, 32)
+}
+
+// deriveMessageKeys calculates the keys for a message given the shared point
+// S, as either e * P (sender) or p * I (recipient)
+func deriveMessageKeys(Sx, Sy *big.Int) (mk *messageKeys) {
+	curve := btcec.S256()
+	S := &btcec.PublicKey{Curve: curve, X: Sx, Y: Sy}
+	mk = new(messageKeys)
+	mk.S = S.SerializeCompressed()
+
+	mk.j = deriveScalar("J", mk.S)
+	Jx, Jy := curve.ScalarBaseMult(mk.j)
+	mk.J = (&btcec.PublicKey{Curve: curve, X: Jx, Y: Jy}).SerializeCompressed()
+
+	mk.k, _ = btcec.PrivKeyFromBytes(curve, deriveScalar("K", mk.S))
+	mk.K = mk.k.PubKey().SerializeCompressed()
+
+	e := sha256.Sum256(append([]byte("E"), mk.S...))
+	mk.E = e[:]
+	return mk
+}
+
+func messageCipherStream(E []byte, I []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(E)
+	if err != nil {
+		return nil, err
+	}
+	iv := sha256.Sum256(I)
+	return cipher.NewCTR(block, iv[:aes.BlockSize]), nil
+}
+
+// NewMessage composes a new V2 message for the recipient public key. The
+// plaintext is encrypted, the header is signed and a nonce is found such that
+// the header hash meets the network target. The message expires ttl after the
+// current time. See the key derivation notes above on compatibility.
+func NewMessage(recipient *btcec.PublicKey, plaintext []byte, ttl time.Duration) (m *Message, err error) {
+	return NewMessageWithExtensions(recipient, plaintext, ttl, nil)
+}
+
+// NewMessageWithExtensions composes a message as NewMessage. If ext is not
+// empty the message is composed with a V3 header carrying the extensions.
+func NewMessageWithExtensions(recipient *btcec.PublicKey, plaintext []byte, ttl time.Duration, ext []HeaderExtension) (m *Message, err error) {
+	curve := btcec.S256()
+
+	if recipient == nil {
+		return nil, errors.New("NewMessage: recipient public key required")
+	}
+	if ttl <= 0 {
+		return nil, errors.New("NewMessage: ttl must be positive")
+	}
+
+	e, err := btcec.NewPrivateKey(curve)
+	if err != nil {
+		return nil, err
+	}
+	Sx, Sy := curve.ScalarMult(recipient.X, recipient.Y, e.D.Bytes())
+	mk := deriveMessageKeys(Sx, Sy)
+
+	m = new(Message)
+	h := &m.RawMessageHeader
+	h.version = "0200"
+	h.time = uint32(time.Now().Unix())
+	h.expire = h.time + uint32(ttl/time.Second)
+	h.I = e.PubKey().SerializeCompressed()
+	h.J = mk.J
+	h.K = mk.K
+	if len(ext) > 0 {
+		err = h.SetExtensions(ext)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// payload = length || plaintext || padding, encrypted in place
+	plen := 4 + len(plaintext)
+	nblocks := (plen + MessageBlockLength - 1) / MessageBlockLength
+	payload := make([]byte, nblocks*MessageBlockLength)
+	binary.BigEndian.PutUint32(payload[:4], uint32(len(plaintext)))
+	copy(payload[4:], plaintext)
+
+	stream, err := messageCipherStream(mk.E, h.I)
+	if err != nil {
+		return nil, err
+	}
+	stream.XORKeyStream(payload, payload)
+
+	m.body = make([]byte, base64.StdEncoding.EncodedLen(len(payload)))
+	base64.StdEncoding.Encode(m.body, payload)
+	h.blocklen = uint32(nblocks)
+
+	// sign short header + body with k
+	h.r = make([]byte, 32)
+	h.s = make([]byte, 32)
+	hash, err := h.signatureHash(bytes.NewReader(m.body))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := mk.k.Sign(hash)
+	if err != nil {
+		return nil, err
+	}
+	h.r = padbytes(sig.R, 32)
+	h.s = padbytes(sig.S, 32)
+
+	err = MineNonce(h, MessageHashTargetBits, 0, context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Bytes returns the complete message file contents (header + body)
+func (m *Message) Bytes() []byte {
+	b := make([]byte, 0, m.RawMessageHeader.serializedLength()+len(m.body))
+	b = append(b, m.RawMessageHeader.Serialize()...)
+	b = append(b, m.body...)
+	return b
+}
+
+// Reader returns a reader for the complete message file contents, suitable
+// for uploading to a message store
+func (m *Message) Reader() io.Reader {
+	return bytes.NewReader(m.Bytes())
+}
+
+// WriteFile writes the message to filepath and returns it as a MessageFile
+func (m *Message) WriteFile(filepath string) (mf *MessageFile, err error) {
+	f, err := os.Create(filepath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(m.Bytes())
+	if err != nil {
+		f.Close()
+		os.Remove(filepath)
+		return nil, err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(filepath)
+		return nil, err
+	}
+	return Ingest(filepath)
+}
+
+// ErrNotRecipient is returned when a message is not addressed to the
+// private key used to decrypt it
+var ErrNotRecipient = errors.New("message not addressed to recipient key")
+
+// recipientKeys derives the message keys from I and the recipient private key
+// and validates them against J (addressing) and K (signature)
+func (z *RawMessageHeader) recipientKeys(priv *btcec.PrivateKey) (mk *messageKeys, err error) {
+	curve := btcec.S256()
+	I, err := btcec.ParsePubKey(z.I, curve)
+	if err != nil {
+		return nil, err
+	}
+	Sx, Sy := curve.ScalarMult(I.X, I.Y, priv.D.Bytes())
+	mk = deriveMessageKeys(Sx, Sy)
+	if !bytes.Equal(mk.J, z.J) {
+		return nil, ErrNotRecipient
+	}
+	if !bytes.Equal(mk.K, z.K) {
+		return nil, &SignatureError{I: z.I, Reason: "K does not match recipient keys"}
+	}
+	return mk, nil
+}
+
+// IsRecipient returns true if the message is addressed to priv. Only
+// messages composed with this package's scheme are recognized (see the key
+// derivation notes above), messages from other clients report false.
+func (z *RawMessageHeader) IsRecipient(priv *btcec.PrivateKey) bool {
+	_, err := z.recipientKeys(priv)
+	return err == nil
+}
+
+// messageReader reads the remaining plaintext bytes, a body which ends
+// before the declared plaintext length is reported as io.ErrUnexpectedEOF
+type messageReader struct {
+	f      *os.File
+	r      io.Reader
+	remain int64
+}
+
+func (mr *messageReader) Read(p []byte) (n int, err error) {
+	if mr.remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > mr.remain {
+		p = p[:mr.remain]
+	}
+	n, err = mr.r.Read(p)
+	mr.remain -= int64(n)
+	if (err == io.EOF) && (mr.remain > 0) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (mr *messageReader) Close() error {
+	return mr.f.Close()
+}
+
+// DecryptMessage opens a stored message with the recipient private key. If
+// the message is not addressed to priv, ErrNotRecipient is returned. The
+// plaintext is decrypted as it is read from the returned reader, which must
+// be closed by the caller. As for IsRecipient, messages composed by other
+// clients are reported as ErrNotRecipient.
+func DecryptMessage(m *MessageFile, priv *btcec.PrivateKey) (r io.ReadCloser, err error) {
+	mk, err := m.RawMessageHeader.recipientKeys(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := messageCipherStream(mk.E, m.I)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(m.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(int64(m.serializedLength()), io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	body := io.LimitReader(f, int64(m.blocklen)*MessageHeaderLengthB64V2)
+	pr := &cipher.StreamReader{S: stream, R: base64.NewDecoder(base64.StdEncoding, body)}
+
+	plen := make([]byte, 4)
+	_, err = io.ReadFull(pr, plen)
+	if err != nil {
+		f.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(plen)
+	if (uint64(n) + 4) > (uint64(m.blocklen) * MessageBlockLength) {
+		f.Close()
+		return nil, errors.New("declared plaintext length exceeds message body")
+	}
+
+	return &messageReader{f: f, r: pr, remain: int64(n)}, nil
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Moving a message file into the store and indexing it (and the reverse)
+// can't be done atomically. A journal entry is written to the database
+// before the first step and cleared after the last, so that an interrupted
+// operation can be completed or rolled back by recoverJournal.
+const (
+	journalInsert = 0x01
+	journalRemove = 0x02
+)
+
+// leftover files in receive/ older than this are considered stale by Fsck
+const fsckReceiveAge = 3600
+
+type journalEntry struct {
+	op   uint8
+	path string // store path (destination for insert)
+	src  string // receive path (insert only)
+}
+
+func (e *journalEntry) serialize() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(e.op)
+	binary.Write(buf, binary.BigEndian, uint16(len(e.path)))
+	buf.WriteString(e.path)
+	buf.WriteString(e.src)
+	return buf.Bytes()
+}
+
+func (e *journalEntry) deserialize(b []byte) error {
+	if len(b) < 3 {
+		return errors.New("journal entry too short")
+	}
+	e.op = b[0]
+	plen := int(binary.BigEndian.Uint16(b[1:3]))
+	if len(b) < 3+plen {
+		return errors.New("journal entry path truncated")
+	}
+	e.path = string(b[3 : 3+plen])
+	e.src = string(b[3+plen:])
+	return nil
+}
+
+// Store moves a verified message file (e.g. from IngestReader) into the
+// store and indexes it. If the message is already stored the file is
+// discarded and the existing servertime returned.
+func (ms *MessageStore) Store(m *MessageFile) (servertime uint32, err error) {
+	ms.opMutex.RLock()
+	defer ms.opMutex.RUnlock()
+
+	previous, err := ms.db.get(m.I)
+	if err == nil {
+		os.Remove(m.Filepath)
+		p := new(MessageFile)
+		if p.Deserialize(previous) == nil {
+			return 0, errors.New("retreived invalid message from database")
+		}
+		return p.Servertime, nil
+	}
+
+	Ihex := hex.EncodeToString(m.I)
+	dest := ms.rootpath + "/store/" + Ihex[:4] + "/" + Ihex
+	e := &journalEntry{op: journalInsert, path: dest, src: m.Filepath}
+	err = ms.db.putJournal(m.I, e.serialize())
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.Move(dest)
+	if err != nil {
+		os.Remove(m.Filepath)
+		ms.db.clearJournal(m.I)
+		return 0, err
+	}
+
+	servertime, err = ms.Insert(m)
+	if err != nil {
+		// Insert does not leave a record on error
+		os.Remove(dest)
+		ms.db.clearJournal(m.I)
+		return 0, err
+	}
+	return servertime, ms.db.clearJournal(m.I)
+}
+
+func (ms *MessageStore) readJournal() (entries map[string]*journalEntry, err error) {
+	entries = make(map[string]*journalEntry)
+	iter := ms.db.iterJournal()
+	defer iter.Release()
+	for iter.Next() {
+		e := new(journalEntry)
+		if e.deserialize(iter.Value()) != nil {
+			e = nil
+		}
+		entries[hex.EncodeToString(iter.Key()[1:])] = e
+	}
+	return entries, iter.Error()
+}
+
+// recoverJournal completes interrupted Remove operations and completes (if
+// the file reached the store) or rolls back interrupted Store operations
+func (ms *MessageStore) recoverJournal() (err error) {
+	entries, err := ms.readJournal()
+	if err != nil {
+		return err
+	}
+	for Ihex, e := range entries {
+		I, _ := hex.DecodeString(Ihex)
+		if e != nil {
+			fmt.Printf("MS: recovering interrupted operation for %s\n", Ihex)
+			ms.recoverEntry(I, e)
+		}
+		err = ms.db.clearJournal(I)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MessageStore) recoverEntry(I []byte, e *journalEntry) {
+	switch e.op {
+	case journalInsert:
+		_, err := os.Stat(e.path)
+		if err == nil {
+			_, err = ms.InsertFile(e.path)
+			if err != nil {
+				fmt.Printf("MS: dropping unindexed message %s: %s\n", e.path, err)
+				os.Remove(e.path)
+			}
+		}
+		if len(e.src) > 0 {
+			os.Remove(e.src)
+		}
+	case journalRemove:
+		value, err := ms.db.get(I)
+		if err == nil {
+			m := new(MessageFile)
+			if m.Deserialize(value) != nil {
+				ms.removeRecord(m, nil)
+			}
+		}
+		os.Remove(e.path)
+	}
+}
+
+// FsckReport lists the inconsistencies between the message store
+// directories and database found by Fsck
+type FsckReport struct {
+	Files         int      // message files checked
+	Records       int      // database records checked
+	Journal       []string // interrupted operations (I)
+	OrphanFiles   []string // files in store/ with no database record
+	OrphanRecords []string // database records with no file (I)
+	BadFiles      []string // files in store/ which are not messages
+	StaleKeys     int      // index keys with no record
+	StaleReceive  []string // leftover files in receive/
+	Repaired      int
+}
+
+// Problems returns the number of inconsistencies found
+func (r *FsckReport) Problems() int {
+	return len(r.Journal) + len(r.OrphanFiles) + len(r.OrphanRecords) + len(r.BadFiles) + r.StaleKeys + len(r.StaleReceive)
+}
+
+func (r *FsckReport) String() string {
+	lines := []string{
+		fmt.Sprintf("checked %d files, %d records", r.Files, r.Records),
+	}
+	list := func(name string, items []string) {
+		for _, i := range items {
+			lines = append(lines, fmt.Sprintf("%s: %s", name, i))
+		}
+	}
+	list("interrupted", r.Journal)
+	list("orphan file", r.OrphanFiles)
+	list("orphan record", r.OrphanRecords)
+	list("bad file", r.BadFiles)
+	list("stale receive", r.StaleReceive)
+	if r.StaleKeys > 0 {
+		lines = append(lines, fmt.Sprintf("stale index keys: %d", r.StaleKeys))
+	}
+	lines = append(lines, fmt.Sprintf("%d problems, %d repaired", r.Problems(), r.Repaired))
+	return strings.Join(lines, "\n")
+}
+
+// Fsck reconciles the message files in store/ and receive/ with the
+// database in both directions. If repair is true unindexed messages are
+// indexed (or quarantined if invalid), records for missing files are dropped
+// and the messages re-fetched, stale index keys and receive/ files are
+// removed and interrupted operations are recovered. Fsck waits for Store and
+// Remove operations in progress and blocks new ones until it completes, so
+// any journal entry found is for an interrupted operation.
+func (ms *MessageStore) Fsck(repair bool) (r *FsckReport, err error) {
+	ms.opMutex.Lock()
+	defer ms.opMutex.Unlock()
+
+	r = new(FsckReport)
+
+	if repair {
+		// the counters are recovered from a clean checkpoint, which no
+		// longer holds once the store is repaired
+		err = ms.checkpoint(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := ms.readJournal()
+	if err != nil {
+		return nil, err
+	}
+	for Ihex := range entries {
+		r.Journal = append(r.Journal, Ihex)
+	}
+	if repair && (len(entries) > 0) {
+		err = ms.recoverJournal()
+		if err != nil {
+			return nil, err
+		}
+		r.Repaired += len(entries)
+	}
+
+	// store -> database
+	for i := 0x200; i < 0x400; i++ {
+		p := fmt.Sprintf("%s/store/%04x", ms.rootpath, i)
+		files, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			r.Files += 1
+			fpath := p + "/" + f.Name()
+			I, err := hex.DecodeString(f.Name())
+			if err != nil || len(I) != 33 {
+				r.BadFiles = append(r.BadFiles, fpath)
+				if repair && os.Rename(fpath, ms.rootpath+"/quarantine/"+f.Name()) == nil {
+					r.Repaired += 1
+				}
+				continue
+			}
+			if ms.db.has(I) || ms.db.hasJournal(I) {
+				continue
+			}
+			r.OrphanFiles = append(r.OrphanFiles, fpath)
+			if repair {
+				_, err = ms.InsertFile(fpath)
+				if err != nil {
+					err = os.Rename(fpath, ms.rootpath+"/quarantine/"+f.Name())
+				}
+				if err == nil {
+					r.Repaired += 1
+				}
+			}
+		}
+	}
+
+	// database -> store, collect first as repair modifies the database
+	iter := ms.db.iterAll()
+	orphans := make([]*MessageFile, 0)
+	for iter.Next() {
+		r.Records += 1
+		m := new(MessageFile)
+		if m.Deserialize(iter.Value()) == nil {
+			continue
+		}
+		_, err := os.Stat(m.Filepath)
+		if os.IsNotExist(err) && !ms.db.hasJournal(m.I) {
+			orphans = append(orphans, m)
+		}
+	}
+	iter.Release()
+	for _, m := range orphans {
+		r.OrphanRecords = append(r.OrphanRecords, hex.EncodeToString(m.I))
+		if repair && ms.removeRecord(m, nil) == nil {
+			ms.refetch(m.I)
+			r.Repaired += 1
+		}
+	}
+
+	stale, err := ms.db.staleKeys()
+	if err != nil {
+		return nil, err
+	}
+	r.StaleKeys = len(stale)
+	if repair && (len(stale) > 0) {
+		batch := new(KVBatch)
+		for _, k := range stale {
+			batch.Delete(k)
+		}
+		if ms.db.write(batch) == nil {
+			r.Repaired += len(stale)
+		}
+	}
+
+	files, err := ioutil.ReadDir(ms.rootpath + "/receive")
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-fsckReceiveAge * time.Second)
+	for _, f := range files {
+		if f.ModTime().After(cutoff) {
+			continue
+		}
+		fpath := ms.rootpath + "/receive/" + f.Name()
+		r.StaleReceive = append(r.StaleReceive, fpath)
+		if repair && os.Remove(fpath) == nil {
+			r.Repaired += 1
+		}
+	}
+
+	if repair {
+		err = ms.recount()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
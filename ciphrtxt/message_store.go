@@ -28,18 +28,19 @@
 package ciphrtxt
 
 import (
+	"bytes"
 	//"net/http"
 	//"io"
-	"io/ioutil"
-	//"encoding/binary"
+	"encoding/binary"
 	"encoding/hex"
+	"io/ioutil"
 	//"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	"math/rand"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -52,19 +53,47 @@ const allowableClockSkew = (60 * 15)
 
 const syncMaxGoroutines = 32
 
+// DefaultStoreCapacity is the default message store quota, in bytes
+const DefaultStoreCapacity = (256 * 1024 * 1024 * 1024)
+
+// eviction starts when usage passes the high water mark and frees space
+// down to the low water mark (percent of capacity)
+const evictionHighWater = 95
+const evictionLowWater = 90
+
+// ErrStoreFull is returned by Insert when a message does not fit in the
+// store quota, even after eviction
+var ErrStoreFull = errors.New("message store full")
+
 type MessageStore struct {
 	rootpath       string
-	db             *leveldb.DB
+	db             *HeaderIndex
 	syncMutex      sync.Mutex
 	syncInProgress bool
-	Count          int
-	sector         ShardSector
-	target         ShardSector
+	sectorMutex    sync.Mutex
+	sectors        ShardSectorSet
+	targets        ShardSectorSet
+	targetGen      int
+	contractGrace  time.Duration
+	contractRate   int
+	done           chan struct{}
 	lastRefresh    uint32
 	syncwg         sync.WaitGroup
 	iqueue         chan []byte
 	quitchan       []chan int
 	LHC            *LocalHeaderCache
+	pow            PoWPolicy
+	requireSig     bool
+	opMutex        sync.RWMutex
+	insertMutex    sync.Mutex
+	usedMutex      sync.Mutex
+	count          int
+	used           int64
+	capacity       int64
+	maxFileSize    int64
+	eviction       EvictionPolicy
+	evicting       bool
+	fsck           bool
 	ExternalHost   string
 	ExternalPort   int
 	ExtTokenPort   int
@@ -118,17 +147,9 @@ func (ms *MessageStore) fetchMessageFromPeers(I []byte) (m *MessageFile) {
 			fmt.Printf("MS: download error getting %s from %s Error: %s\n", hex.EncodeToString(I), phc.baseurl, err)
 			continue
 		}
-		Ihex := hex.EncodeToString(I)
-		filemove := ms.rootpath + "/store/" + Ihex[:4] + "/" + Ihex
-		//fmt.Printf("moving to %s\n", filemove)
-		err = m.Move(filemove)
-		if err != nil {
-			fmt.Printf("err: move \n")
-			continue
-		}
-		_, err = ms.Insert(m)
+		_, err = ms.Store(m)
 		if err != nil {
-			fmt.Printf("err: Insert\n")
+			fmt.Printf("MS: store error for %s: %s\n", hex.EncodeToString(I), err)
 			continue
 		}
 		return m
@@ -142,22 +163,26 @@ func OpenMessageStore(filepath string, lhc *LocalHeaderCache, startbin int) (ms
 		return nil, err
 	}
 
-	err = CheckOrCreateDirectory(filepath + "/store")
+	kv, err := OpenLevelDBStore(filepath + "/msgdb")
 	if err != nil {
 		return nil, err
 	}
 
-	err = CheckOrCreateDirectory(filepath + "/receive")
+	ms, err = OpenMessageStoreKV(filepath, lhc, startbin, kv)
 	if err != nil {
+		kv.Close()
 		return nil, err
 	}
+	return ms, nil
+}
 
-	ms = new(MessageStore)
-	ms.rootpath = filepath
-	ms.sector.Start = startbin
-	ms.sector.Ring = ShardSectorOuterRing
-	ms.LHC = lhc
-	lhc.ms = ms
+// OpenMessageStoreKV opens a message store rooted at filepath which keeps its
+// message index in kv. Message files are always stored on disk.
+func OpenMessageStoreKV(filepath string, lhc *LocalHeaderCache, startbin int, kv KVStore) (ms *MessageStore, err error) {
+	ms, err = newMessageStore(filepath, lhc, startbin, kv)
+	if err != nil {
+		return nil, err
+	}
 
 	ms.iqueue = make(chan []byte, (5 * syncMaxGoroutines))
 	ms.quitchan = make([]chan int, syncMaxGoroutines)
@@ -192,65 +217,144 @@ func OpenMessageStore(filepath string, lhc *LocalHeaderCache, startbin int) (ms
 	}
 	fmt.Printf("MS: Started %d download goroutines\n", syncMaxGoroutines)
 
-	ms.db, err = leveldb.OpenFile(filepath+"/msgdb", nil)
+	// stores created before the message time index was kept need it built
+	err = ms.db.enableDate(func(value []byte) (*dbkeys, error) {
+		m := new(MessageFile)
+		if m.Deserialize(value) == nil {
+			return nil, errors.New("error parsing message")
+		}
+		return m.RawMessageHeader.dbKeys(m.Servertime)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	for i := 0x200; i < 0x400; i++ {
-		p := fmt.Sprintf("%s/store/%04x", filepath, i)
-		err = CheckOrCreateDirectory(p)
-		if err != nil {
-			return nil, err
-		}
+	// a clean shutdown checkpoint means the database is consistent with the
+	// store directories, so the full scan can be skipped
+	clean := ms.recoverCheckpoint() == nil
+
+	err = ms.recoverJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	// mark dirty until Close
+	err = ms.checkpoint(false)
+	if err != nil {
+		return nil, err
+	}
 
-		files, err := ioutil.ReadDir(p)
+	if clean {
+		fmt.Printf("MS: recovered clean checkpoint, skipping store scan\n")
+	} else {
+		_, err = ms.Rescan()
 		if err != nil {
 			return nil, err
 		}
-
-		for _, f := range files {
-			//fmt.Printf("Found file %s in %s\n", f.Name(), p)
-			dbkey, err := hex.DecodeString(f.Name())
-			if err != nil {
-				fmt.Printf("Error parsing %s as hex\n", f.Name())
-				continue
-			}
-			_, err = ms.db.Get(dbkey, nil)
-			if err != nil {
-				//fmt.Printf("%s not found in db, inserting\n", f.Name())
-				fpath := p + "/" + f.Name()
-				//ins, err := ms.InsertFile(fpath)
-				_, err := ms.InsertFile(fpath)
-				if err != nil {
-					fmt.Printf("Failed to insert message %s\n", fpath)
-					continue
-				}
-				//if ins != 0 {
-				//    fmt.Printf("inserted %s into db\n", f.Name())
-				//}
-			}
-		}
 	}
 
 	ms.pruneExpired()
 
-	err = ms.recount()
+	err = ms.syncLHC()
 	if err != nil {
 		return nil, err
 	}
 
-	err = ms.syncLHC()
+	fmt.Printf("MessageStore open, found %d messages\n", ms.Count())
+	return ms, nil
+}
+
+// OpenMessageStoreFsck opens the message store rooted at filepath for Fsck
+// only. Interrupted operations are not recovered, the store is not scanned or
+// pruned, no downloads are started and Close does not write a checkpoint, so
+// Fsck(false) reports the store as it was found. Fsck(true) repairs the
+// store but does not fetch missing messages.
+func OpenMessageStoreFsck(filepath string, lhc *LocalHeaderCache) (ms *MessageStore, err error) {
+	err = CheckOrCreateDirectory(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := OpenLevelDBStore(filepath + "/msgdb")
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err = OpenMessageStoreFsckKV(filepath, lhc, kv)
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return ms, nil
+}
+
+// OpenMessageStoreFsckKV opens a message store for Fsck as
+// OpenMessageStoreFsck, with the message index in kv
+func OpenMessageStoreFsckKV(filepath string, lhc *LocalHeaderCache, kv KVStore) (ms *MessageStore, err error) {
+	ms, err = newMessageStore(filepath, lhc, 0, kv)
+	if err != nil {
+		return nil, err
+	}
+	ms.fsck = true
+
+	// the date index is kept only if already built, otherwise it is built
+	// on the next (normal) open
+	err = ms.db.loadDate()
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// newMessageStore creates the store directories and the MessageStore, with
+// no background activity
+func newMessageStore(filepath string, lhc *LocalHeaderCache, startbin int, kv KVStore) (ms *MessageStore, err error) {
+	err = CheckOrCreateDirectory(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = CheckOrCreateDirectory(filepath + "/store")
+	if err != nil {
+		return nil, err
+	}
+
+	err = CheckOrCreateDirectory(filepath + "/receive")
+	if err != nil {
+		return nil, err
+	}
+
+	err = CheckOrCreateDirectory(filepath + "/quarantine")
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("MessageStore open, found %d messages\n", ms.Count)
+	for i := 0x200; i < 0x400; i++ {
+		err = CheckOrCreateDirectory(fmt.Sprintf("%s/store/%04x", filepath, i))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ms = new(MessageStore)
+	ms.rootpath = filepath
+	ms.sectors = ShardSectorSet{{Start: startbin, Ring: ShardSectorOuterRing}}
+	ms.contractGrace = DefaultContractionGrace
+	ms.done = make(chan struct{})
+	ms.LHC = lhc
+	ms.pow = lhc.pow
+	ms.capacity = DefaultStoreCapacity
+	ms.maxFileSize = MaxMessageFileSize
+	ms.eviction = DefaultEvictionPolicy
+	lhc.ms = ms
+
+	ms.db = NewHeaderIndex(kv, false)
 	return ms, nil
 }
 
 func (ms *MessageStore) Close() {
 	fmt.Printf("MessageStore:Close : sending close to all goroutines\n")
+	close(ms.done)
 	//send quit to all workers
 	for _, c := range ms.quitchan {
 		c <- 0
@@ -259,11 +363,117 @@ func (ms *MessageStore) Close() {
 	ms.syncwg.Wait()
 	fmt.Printf("MessageStore:Close : all goroutines completed\n")
 	if ms.db != nil {
-		ms.db.Close()
+		if !ms.fsck {
+			err := ms.checkpoint(true)
+			if err != nil {
+				fmt.Printf("MessageStore:Close : checkpoint failed: %s\n", err)
+			}
+		}
+		ms.db.close()
 		ms.db = nil
 	}
 }
 
+// checkpoint persists the message count and usage, and whether the store
+// was closed cleanly
+func (ms *MessageStore) checkpoint(clean bool) (err error) {
+	buf := new(bytes.Buffer)
+	if clean {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(buf, binary.BigEndian, uint64(ms.Count()))
+	binary.Write(buf, binary.BigEndian, uint64(ms.Used()))
+	value := buf.Bytes()[:]
+	key := []byte("\000\000\000\000")
+	return ms.db.putMeta(key, value)
+}
+
+// recoverCheckpoint restores the counters from a clean shutdown checkpoint
+// and returns an error if there is none
+func (ms *MessageStore) recoverCheckpoint() (err error) {
+	key := []byte("\000\000\000\000")
+	value, err := ms.db.getMeta(key)
+	if err != nil {
+		return err
+	}
+
+	if len(value) != 17 {
+		return fmt.Errorf("checkpoint value length mismatch")
+	}
+	if value[0] != 1 {
+		return fmt.Errorf("message store was not closed cleanly")
+	}
+	ms.usedMutex.Lock()
+	ms.count = int(binary.BigEndian.Uint64(value[1:9]))
+	ms.used = int64(binary.BigEndian.Uint64(value[9:17]))
+	ms.usedMutex.Unlock()
+	return nil
+}
+
+// Rescan indexes any message files in the store directories which are not
+// in the database. The directories are scanned in parallel. It returns the
+// number of messages inserted. The counters are recounted when the scan
+// completes, in case of messages inserted by downloads during the scan.
+func (ms *MessageStore) Rescan() (inserted int, err error) {
+	fmt.Printf("MS: scanning store for unindexed messages\n")
+	workers := runtime.NumCPU()
+	dirs := make(chan int, 0x200)
+	for i := 0x200; i < 0x400; i++ {
+		dirs <- i
+	}
+	close(dirs)
+
+	var wg sync.WaitGroup
+	var resultMutex sync.Mutex
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range dirs {
+				p := fmt.Sprintf("%s/store/%04x", ms.rootpath, i)
+				files, derr := ioutil.ReadDir(p)
+				if derr != nil {
+					resultMutex.Lock()
+					err = derr
+					resultMutex.Unlock()
+					continue
+				}
+
+				for _, f := range files {
+					//fmt.Printf("Found file %s in %s\n", f.Name(), p)
+					dbkey, herr := hex.DecodeString(f.Name())
+					if herr != nil {
+						fmt.Printf("Error parsing %s as hex\n", f.Name())
+						continue
+					}
+					if ms.db.has(dbkey) {
+						continue
+					}
+					//fmt.Printf("%s not found in db, inserting\n", f.Name())
+					fpath := p + "/" + f.Name()
+					_, ierr := ms.InsertFile(fpath)
+					if ierr != nil {
+						fmt.Printf("Failed to insert message %s\n", fpath)
+						continue
+					}
+					resultMutex.Lock()
+					inserted += 1
+					resultMutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		return inserted, err
+	}
+
+	fmt.Printf("MS: scan inserted %d messages\n", inserted)
+	return inserted, ms.recount()
+}
+
 func (ms *MessageStore) recount() (err error) {
 	emptyMessage := "000000000000000000000000000000000000000000000000000000000000000000"
 	expiredBegin, err := hex.DecodeString("E0" + "00000000" + emptyMessage)
@@ -275,16 +485,28 @@ func (ms *MessageStore) recount() (err error) {
 		return err
 	}
 
-	iter := ms.db.NewIterator(&util.Range{Start: expiredBegin, Limit: expiredEnd}, nil)
+	// inserts wait for the count, so none are counted twice or missed
+	ms.insertMutex.Lock()
+	defer ms.insertMutex.Unlock()
+
+	iter := ms.db.iter(expiredBegin, expiredEnd)
 
 	count := int(0)
+	used := int64(0)
+	m := new(MessageFile)
 
 	for iter.Next() {
 		count += 1
+		if m.Deserialize(iter.Value()) != nil {
+			used += m.fileSize()
+		}
 	}
 	iter.Release()
 
-	ms.Count = count
+	ms.usedMutex.Lock()
+	ms.count = count
+	ms.used = used
+	ms.usedMutex.Unlock()
 
 	return nil
 }
@@ -302,7 +524,8 @@ func (ms *MessageStore) syncLHC() (err error) {
 		return err
 	}
 
-	iter := ms.db.NewIterator(&util.Range{Start: iBegin, Limit: iEnd}, nil)
+	iter := ms.db.iter(iBegin, iEnd)
+	defer iter.Release()
 
 	for iter.Next() {
 		_, err := lhc.FindByI(iter.Key())
@@ -314,29 +537,206 @@ func (ms *MessageStore) syncLHC() (err error) {
 			}
 			_, err := lhc.Insert(&(m.RawMessageHeader))
 			if err != nil {
-				return err
+				fmt.Printf("MS: syncLHC insert failed: %s\n", err)
+				continue
 			}
 		}
 	}
-	iter.Release()
 
 	return nil
 }
 
 func (ms *MessageStore) InsertFile(filepath string) (servertime uint32, err error) {
-	m := Ingest(filepath)
-	if m == nil {
-		return 0, fmt.Errorf("Ingest failed for %s\n", filepath)
+	m, err := Ingest(filepath)
+	if err != nil {
+		return 0, fmt.Errorf("Ingest failed for %s: %s\n", filepath, err)
 	}
 	return ms.Insert(m)
 }
 
+// SetPoWPolicy sets the policy used to validate messages on Insert. The
+// policy is also applied to the local header cache.
+func (ms *MessageStore) SetPoWPolicy(p PoWPolicy) {
+	ms.pow = p
+	ms.LHC.SetPoWPolicy(p)
+}
+
+// PoWPolicy returns the policy used to validate messages
+func (ms *MessageStore) PoWPolicy() PoWPolicy {
+	return ms.pow
+}
+
+// SetRequireSignatures sets whether Insert rejects messages whose signature
+// does not verify (see RawMessageHeader.Verify). It is off by default.
+func (ms *MessageStore) SetRequireSignatures(require bool) {
+	ms.requireSig = require
+}
+
+// RequireSignatures returns whether Insert rejects unsigned messages
+func (ms *MessageStore) RequireSignatures() bool {
+	return ms.requireSig
+}
+
+// SetQuota sets the store capacity and maximum message file size, in bytes
+func (ms *MessageStore) SetQuota(capacity int64, maxFileSize int64) {
+	ms.usedMutex.Lock()
+	ms.capacity = capacity
+	ms.maxFileSize = maxFileSize
+	ms.usedMutex.Unlock()
+}
+
+// SetEvictionPolicy sets the policy used to select messages to drop when
+// the store nears capacity
+func (ms *MessageStore) SetEvictionPolicy(p EvictionPolicy) {
+	ms.eviction = p
+}
+
+// MaxFileSize returns the largest message file the store will accept
+func (ms *MessageStore) MaxFileSize() int64 {
+	ms.usedMutex.Lock()
+	defer ms.usedMutex.Unlock()
+	return ms.maxFileSize
+}
+
+// Used returns the total size of stored message files, in bytes
+func (ms *MessageStore) Used() int64 {
+	ms.usedMutex.Lock()
+	defer ms.usedMutex.Unlock()
+	return ms.used
+}
+
+func (ms *MessageStore) addUsed(n int64) {
+	ms.usedMutex.Lock()
+	ms.used += n
+	ms.usedMutex.Unlock()
+}
+
+// Count returns the number of stored messages
+func (ms *MessageStore) Count() int {
+	ms.usedMutex.Lock()
+	defer ms.usedMutex.Unlock()
+	return ms.count
+}
+
+func (ms *MessageStore) addCount(n int) {
+	ms.usedMutex.Lock()
+	ms.count += n
+	ms.usedMutex.Unlock()
+}
+
+// reserve checks there is space for size bytes. If adding size bytes would
+// pass the high water mark messages are evicted first.
+func (ms *MessageStore) reserve(size int64) (err error) {
+	ms.usedMutex.Lock()
+	if size > ms.maxFileSize {
+		ms.usedMutex.Unlock()
+		return ErrMessageTooLarge
+	}
+	high := (ms.used + size) > (ms.capacity/100)*evictionHighWater
+	ms.usedMutex.Unlock()
+	if !high {
+		return nil
+	}
+
+	_, err = ms.evict(size)
+	if err != nil {
+		return err
+	}
+
+	ms.usedMutex.Lock()
+	defer ms.usedMutex.Unlock()
+	if (ms.used + size) > ms.capacity {
+		return ErrStoreFull
+	}
+	return nil
+}
+
+// Evict drops messages (in eviction policy order) until usage is below
+// the low water mark and returns the number of messages dropped
+func (ms *MessageStore) Evict() (n int, err error) {
+	ms.opMutex.RLock()
+	defer ms.opMutex.RUnlock()
+	return ms.evict(0)
+}
+
+func (ms *MessageStore) evict(reserve int64) (n int, err error) {
+	ms.usedMutex.Lock()
+	if ms.evicting {
+		ms.usedMutex.Unlock()
+		return 0, nil
+	}
+	ms.evicting = true
+	goal := (ms.capacity/100)*evictionLowWater - reserve
+	ms.usedMutex.Unlock()
+
+	defer func() {
+		ms.usedMutex.Lock()
+		ms.evicting = false
+		ms.usedMutex.Unlock()
+	}()
+
+	if ms.Used() <= goal {
+		return 0, nil
+	}
+
+	emptyMessage := "0000000000000000000000000000000000000000000000000000000000000000"
+	iBegin, err := hex.DecodeString("02" + emptyMessage)
+	if err != nil {
+		return 0, err
+	}
+	iEnd, err := hex.DecodeString("04" + emptyMessage)
+	if err != nil {
+		return 0, err
+	}
+
+	// collect first, Remove modifies the database
+	iter := ms.db.iter(iBegin, iEnd)
+	msgs := make([]*MessageFile, 0)
+	for iter.Next() {
+		m := new(MessageFile)
+		if m.Deserialize(iter.Value()) == nil {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	iter.Release()
+
+	sort.Sort(evictionSlice{msgs: msgs, policy: ms.eviction, target: ms.GetCurrentTargets()})
+
+	for _, m := range msgs {
+		if ms.Used() <= goal {
+			break
+		}
+		err = ms.remove(m)
+		if err != nil {
+			fmt.Printf("MS: evict %s failed: %s\n", hex.EncodeToString(m.I), err)
+			continue
+		}
+		n += 1
+	}
+	if n > 0 {
+		fmt.Printf("MS: evicted %d messages (%s), %d bytes used\n", n, ms.eviction.Name(), ms.Used())
+	}
+	return n, nil
+}
+
 func (ms *MessageStore) Insert(m *MessageFile) (servertime uint32, err error) {
+	err = CheckPoW(ms.pow, &m.RawMessageHeader)
+	if err != nil {
+		return 0, err
+	}
 	dbk, err := m.RawMessageHeader.dbKeys(m.Servertime)
 	if err != nil {
 		return 0, err
 	}
-	previous, err := ms.db.Get(dbk.I, nil)
+
+	// inserts are serialized from the duplicate check to the counter update,
+	// so that concurrent inserts of the same message are counted once and
+	// the space checked by reserve is still free when the record is written
+	ms.insertMutex.Lock()
+	defer ms.insertMutex.Unlock()
+
+	previous, err := ms.db.get(dbk.I)
 	if err == nil {
 		p := new(MessageFile)
 		if p.Deserialize(previous) == nil {
@@ -344,72 +744,249 @@ func (ms *MessageStore) Insert(m *MessageFile) (servertime uint32, err error) {
 		}
 		return p.Servertime, nil
 	}
+	if !m.verified && ms.RequireSignatures() {
+		err = m.Verify()
+		if err != nil {
+			return 0, err
+		}
+	}
+	size := m.fileSize()
+	err = ms.reserve(size)
+	if err != nil {
+		return 0, err
+	}
 	value := []byte(m.Serialize())
-	batch := new(leveldb.Batch)
-	batch.Put(dbk.servertime, value)
-	batch.Put(dbk.expire, value)
-	batch.Put(dbk.I, value)
-	err = ms.db.Write(batch, nil)
+	err = ms.db.insert(dbk, value)
 	if err != nil {
 		return 0, err
 	}
-	ms.Count += 1
 	_, err = ms.LHC.Insert(&(m.RawMessageHeader))
 	if err != nil {
+		ms.db.remove(dbk)
 		return 0, err
 	}
+	ms.addCount(1)
+	ms.addUsed(size)
 	return m.Servertime, nil
 }
 
+// Remove drops a message from the database and deletes the file. The file
+// removal is journaled with the database update.
 func (ms *MessageStore) Remove(m *MessageFile) (err error) {
+	ms.opMutex.RLock()
+	defer ms.opMutex.RUnlock()
+	return ms.remove(m)
+}
+
+// remove is Remove without taking opMutex, for eviction (which runs within
+// Store or Fsck)
+func (ms *MessageStore) remove(m *MessageFile) (err error) {
+	e := &journalEntry{op: journalRemove, path: m.Filepath}
+	err = ms.removeRecord(m, e)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(m.Filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ms.db.clearJournal(m.I)
+}
+
+// removeRecord drops a message from the database. If e is not nil the
+// journal entry is written in the same batch.
+func (ms *MessageStore) removeRecord(m *MessageFile, e *journalEntry) (err error) {
 	dbk, err := m.RawMessageHeader.dbKeys(m.Servertime)
 	if err != nil {
 		return err
 	}
-	batch := new(leveldb.Batch)
-	batch.Delete(dbk.servertime)
-	batch.Delete(dbk.expire)
-	batch.Delete(dbk.I)
-	err = ms.db.Write(batch, nil)
-	if err == nil {
-		return os.Remove(m.Filepath)
+	batch := new(KVBatch)
+	ms.db.batchRemove(batch, dbk)
+	if e != nil {
+		ms.db.batchJournal(batch, m.I, e.serialize())
+	}
+	err = ms.db.write(batch)
+	if err != nil {
+		return err
 	}
-	ms.Count -= 1
-	return err
+	ms.addCount(-1)
+	ms.addUsed(-m.fileSize())
+	return nil
 }
 
-func (ms *MessageStore) FindSince(tstamp uint32) (msgs []MessageFile, err error) {
-	ms.Sync()
+// quarantine moves a corrupted message file out of the store, drops it from
+// the database and queues it to be fetched again from peers. The header is
+// retained in the local header cache.
+func (ms *MessageStore) quarantine(m *MessageFile) (err error) {
+	Ihex := hex.EncodeToString(m.I)
+	fmt.Printf("MS: quarantining corrupted message %s\n", Ihex)
+	err = ms.removeRecord(m, nil)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(m.Filepath, ms.rootpath+"/quarantine/"+Ihex)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ms.refetch(m.I)
+	return nil
+}
 
-	emptyMessage := "000000000000000000000000000000000000000000000000000000000000000000"
-	tag1 := fmt.Sprintf("C0%08X%s", tstamp, emptyMessage)
-	tag2 := "C0" + "FFFFFFFF" + emptyMessage
+// refetch queues a message to be downloaded from peers
+func (ms *MessageStore) refetch(I []byte) {
+	select {
+	case ms.iqueue <- I:
+	default:
+		// queue full, will be picked up by the next sector refresh
+	}
+}
 
-	bin1, err := hex.DecodeString(tag1)
+// CheckMessage validates a stored message against its content digest (or,
+// for records without one, the signature if signatures are required). If
+// the file is corrupted (or missing) it is quarantined and re-fetched and
+// the error is returned.
+func (ms *MessageStore) CheckMessage(m *MessageFile) (err error) {
+	if (len(m.Digest) == 0) && ms.RequireSignatures() {
+		err = m.Verify()
+	} else {
+		err = m.CheckDigest()
+	}
 	if err != nil {
-		return nil, err
+		ms.opMutex.RLock()
+		qerr := ms.quarantine(m)
+		ms.opMutex.RUnlock()
+		if qerr != nil {
+			fmt.Printf("MS: quarantine failed for %s: %s\n", hex.EncodeToString(m.I), qerr)
+		}
+		return err
 	}
-	bin2, err := hex.DecodeString(tag2)
+	return nil
+}
+
+// Scrub checks every stored message against its content digest, quarantining
+// (and re-fetching) any which are corrupted. It returns the number of
+// corrupted messages found.
+func (ms *MessageStore) Scrub() (bad int, err error) {
+	emptyMessage := "0000000000000000000000000000000000000000000000000000000000000000"
+	iBegin, err := hex.DecodeString("02" + emptyMessage)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	iEnd, err := hex.DecodeString("04" + emptyMessage)
+	if err != nil {
+		return 0, err
+	}
+
+	// collect first, quarantine modifies the database
+	iter := ms.db.iter(iBegin, iEnd)
+	msgs := make([]*MessageFile, 0)
+	for iter.Next() {
+		m := new(MessageFile)
+		if m.Deserialize(iter.Value()) == nil {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range msgs {
+		if ms.CheckMessage(m) != nil {
+			bad += 1
+		}
+	}
+	if bad > 0 {
+		fmt.Printf("MS: scrub found %d corrupted messages of %d\n", bad, len(msgs))
 	}
+	return bad, nil
+}
+
+func (ms *MessageStore) FindSince(tstamp uint32) (msgs []MessageFile, err error) {
+	return collectMessages(ms.IterSince(tstamp, 0))
+}
+
+// IterSince iterates over messages received at or after tstamp (servertime)
+// in servertime order, stopping after limit messages if limit > 0
+func (ms *MessageStore) IterSince(tstamp uint32, limit int) MessageIterator {
+	ms.Sync()
 
-	iter := ms.db.NewIterator(&util.Range{Start: bin1, Limit: bin2}, nil)
+	start, end := timeRange(indexPrefixServertime, tstamp)
+	return newMessageIterator(ms.db, start, end, limit)
+}
+
+// IterCursor resumes the iteration which returned the cursor c
+func (ms *MessageStore) IterCursor(c HeaderCursor, limit int) MessageIterator {
+	ms.Sync()
+
+	return newMessageCursorIterator(ms.db, c, limit)
+}
+
+// FindByTimeRange returns the messages with message time in [from, to) in
+// message time order
+func (ms *MessageStore) FindByTimeRange(from uint32, to uint32) (msgs []MessageFile, err error) {
+	return collectMessages(ms.IterTimeRange(from, to, 0))
+}
+
+// IterTimeRange iterates over messages with message time in [from, to),
+// stopping after limit messages if limit > 0
+func (ms *MessageStore) IterTimeRange(from uint32, to uint32, limit int) MessageIterator {
+	start, end := dateRange(from, to)
+	return newMessageIterator(ms.db, start, end, limit)
+}
+
+// IterTimeRangeCursor resumes the IterTimeRange which returned the cursor c
+func (ms *MessageStore) IterTimeRangeCursor(c HeaderCursor, to uint32, limit int) MessageIterator {
+	return newMessageDateCursorIterator(ms.db, c, to, limit)
+}
+
+// EnableRecipientIndex builds and maintains the J and K indexes used by
+// FindByJ and FindByK
+func (ms *MessageStore) EnableRecipientIndex() (err error) {
+	return ms.db.enableRecipient(func(value []byte) (*dbkeys, error) {
+		m := new(MessageFile)
+		if m.Deserialize(value) == nil {
+			return nil, errors.New("error parsing message")
+		}
+		return m.RawMessageHeader.dbKeys(m.Servertime)
+	})
+}
+
+// FindByJ returns the messages with J beginning with prefix
+func (ms *MessageStore) FindByJ(prefix []byte) (msgs []MessageFile, err error) {
+	return ms.findRecipient(indexPrefixJ, prefix)
+}
+
+// FindByK returns the messages with K beginning with prefix
+func (ms *MessageStore) FindByK(prefix []byte) (msgs []MessageFile, err error) {
+	return ms.findRecipient(indexPrefixK, prefix)
+}
+
+func (ms *MessageStore) findRecipient(index byte, prefix []byte) (msgs []MessageFile, err error) {
+	if !ms.db.recipient {
+		return nil, ErrRecipientIndexDisabled
+	}
+
+	iter := ms.db.iterPrefix(index, prefix)
+	defer iter.Release()
 
 	msgs = make([]MessageFile, 0)
 	for iter.Next() {
 		m := new(MessageFile)
-		value := iter.Value()
-		if m.Deserialize(value) == nil {
+		if m.Deserialize(iter.Value()) == nil {
 			return nil, errors.New("error parsing message")
 		}
 		msgs = append(msgs, *m)
 	}
-
 	return msgs, nil
 }
 
 func (ms *MessageStore) pruneExpired() (err error) {
+	ms.opMutex.RLock()
+	defer ms.opMutex.RUnlock()
+
 	emptyMessage := "000000000000000000000000000000000000000000000000000000000000000000"
 	expiredBegin, err := hex.DecodeString("E0" + "00000000" + emptyMessage)
 	if err != nil {
@@ -421,35 +998,42 @@ func (ms *MessageStore) pruneExpired() (err error) {
 		return err
 	}
 
-	iter := ms.db.NewIterator(&util.Range{Start: expiredBegin, Limit: expiredEnd}, nil)
-	batch := new(leveldb.Batch)
+	iter := ms.db.iter(expiredBegin, expiredEnd)
+	batch := new(KVBatch)
 	m := new(MessageFile)
 
 	delCount := int(0)
+	delSize := int64(0)
 	filesToRemove := make([]string, 0, 1024)
+	idsToClear := make([][]byte, 0, 1024)
 
 	for iter.Next() {
 		if m.Deserialize(iter.Value()) == nil {
+			iter.Release()
 			return errors.New("unable to parse database value")
 		}
 		dbk, err := m.RawMessageHeader.dbKeys(m.Servertime)
 		if err != nil {
+			iter.Release()
 			return err
 		}
-		batch.Delete(dbk.servertime)
-		batch.Delete(dbk.expire)
-		batch.Delete(dbk.I)
+		ms.db.batchRemove(batch, dbk)
+		e := &journalEntry{op: journalRemove, path: m.Filepath}
+		ms.db.batchJournal(batch, m.I, e.serialize())
 		delCount += 1
+		delSize += m.fileSize()
 		filesToRemove = append(filesToRemove, m.Filepath)
+		idsToClear = append(idsToClear, append([]byte{}, m.I...))
 	}
 	iter.Release()
 
-	err = ms.db.Write(batch, nil)
+	err = ms.db.write(batch)
 	if err != nil {
 		return err
 	}
 
-	ms.Count -= delCount
+	ms.addCount(-delCount)
+	ms.addUsed(-delSize)
 	//fmt.Printf("MessageStore: dropped %d messages from db\n", delCount)
 
 	delCount = 0
@@ -460,6 +1044,15 @@ func (ms *MessageStore) pruneExpired() (err error) {
 		}
 	}
 
+	batch = new(KVBatch)
+	for _, I := range idsToClear {
+		ms.db.batchClearJournal(batch, I)
+	}
+	err = ms.db.write(batch)
+	if err != nil {
+		return err
+	}
+
 	//fmt.Printf("MessageStore: removed %d messages from filesystem\n", delCount)
 
 	return nil
@@ -468,7 +1061,7 @@ func (ms *MessageStore) pruneExpired() (err error) {
 func (ms *MessageStore) FindByI(I []byte) (m *MessageFile, err error) {
 	//ms.Sync()
 
-	value, err := ms.db.Get(I, nil)
+	value, err := ms.db.get(I)
 	if err != nil {
 		return nil, err
 	}
@@ -482,13 +1075,15 @@ func (ms *MessageStore) FindByI(I []byte) (m *MessageFile, err error) {
 func (ms *MessageStore) FindOrFetchByI(I []byte) (m *MessageFile, err error) {
 	//ms.Sync()
 
-	value, err := ms.db.Get(I, nil)
+	value, err := ms.db.get(I)
 	if err == nil {
 		m = new(MessageFile)
 		if m.Deserialize(value) == nil {
 			return nil, errors.New("retreived invalid message from database")
 		}
-	} else {
+		err = ms.CheckMessage(m)
+	}
+	if err != nil {
 		m = ms.fetchMessageFromPeers(I)
 		if m == nil {
 			return nil, errors.New("message not found")
@@ -497,38 +1092,43 @@ func (ms *MessageStore) FindOrFetchByI(I []byte) (m *MessageFile, err error) {
 	return m, nil
 }
 
-func (ms *MessageStore) syncSector(sector ShardSector) (err error) {
+func (ms *MessageStore) syncSector(sectors ShardSectorSet) (err error) {
 	lhc := ms.LHC
 	lhc.Sync()
 
-	fmt.Printf("MessageStore.syncSector : refresh %04x-%d\n", sector.Start, sector.Ring)
+	fmt.Printf("MessageStore.syncSector : refresh %s\n", sectors)
 
-	segHeaders, err := lhc.findSector(sector)
-	if err != nil {
-		return err
-	}
+	for _, sector := range sectors {
+		segHeaders, err := lhc.findSector(sector)
+		if err != nil {
+			return err
+		}
 
-	//fmt.Printf("MessageStore.syncSector: %d headers in scope\n", len(segHeaders))
+		//fmt.Printf("MessageStore.syncSector: %d headers in scope\n", len(segHeaders))
 
-	for _, s := range segHeaders {
-		if s.version == "0100" {
-			continue
-		}
-		_, err = ms.FindByI(s.I)
-		if err != nil {
-			//fmt.Printf("MessageStore.syncSector : queueing %s\n", hex.EncodeToString(s.I))
-			ms.iqueue <- s.I
+		for i := range segHeaders {
+			s := &segHeaders[i]
+			if s.isV1() {
+				continue
+			}
+			_, err = ms.FindByI(s.IKey())
+			if err != nil {
+				//fmt.Printf("MessageStore.syncSector : queueing %s\n", hex.EncodeToString(s.I))
+				if !ms.queue(s.IKey()) {
+					return nil
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
-func (ms *MessageStore) refreshSector(sector ShardSector, since uint32) (err error) {
+func (ms *MessageStore) refreshSector(sectors ShardSectorSet, since uint32) (err error) {
 	lhc := ms.LHC
 	lhc.Sync()
 
-	fmt.Printf("MessageStore.refreshSector : refresh %04x-%d\n", sector.Start, sector.Ring)
+	fmt.Printf("MessageStore.refreshSector : refresh %s\n", sectors)
 
 	segHeaders, err := lhc.FindSince(since)
 	if err != nil {
@@ -537,15 +1137,18 @@ func (ms *MessageStore) refreshSector(sector ShardSector, since uint32) (err err
 
 	//fmt.Printf("")
 
-	for _, s := range segHeaders {
-		if s.version == "0100" {
+	for i := range segHeaders {
+		s := &segHeaders[i]
+		if s.isV1() {
 			continue
 		}
-		if sector.Contains(s.I) {
-			_, err = ms.FindByI(s.I)
+		if sectors.Contains(s.IKey()) {
+			_, err = ms.FindByI(s.IKey())
 			if err != nil {
 				//fmt.Printf("MessageStore.refreshSector : queueing %s\n", hex.EncodeToString(s.I))
-				ms.iqueue <- s.I
+				if !ms.queue(s.IKey()) {
+					return nil
+				}
 			}
 		}
 	}
@@ -553,57 +1156,131 @@ func (ms *MessageStore) refreshSector(sector ShardSector, since uint32) (err err
 	return nil
 }
 
-func (ms *MessageStore) populate(ring uint) (err error) {
-	if ring > ShardSectorOuterRing {
-		ring = ShardSectorOuterRing
-	}
-
-	newSync := ms.LHC.lastRefresh
+// populate grows coverage toward each target sector, starting from the
+// outer ring sector at its start and stepping "down" one ring at a time. It
+// stops if the store is closed or the targets (generation gen) are replaced.
+func (ms *MessageStore) populate(targets ShardSectorSet, gen int) (err error) {
 	lastSync := ms.LHC.lastRefresh
-	currentRing := ms.sector.Ring
-	target := ms.sector
-
-	// validate that the current sector is covered
 
-	ms.syncSector(ms.sector)
+	for _, target := range targets {
+		sector := ShardSector{
+			Start: target.Start,
+			Ring:  ShardSectorOuterRing,
+		}
 
-	// step "down" one ring at a time: add "next" sector; refresh new for combined
+		// validate that the initial sector is covered
 
-	for r := currentRing; r > ring; r-- {
-		extent := 512 >> r
-		target = ShardSector{
-			Start: ((ms.sector.Start + extent) & 0x01ff) | 0x0200,
-			Ring:  r,
+		ms.syncSector(ShardSectorSet{sector})
+		if !ms.addSector(sector, gen) {
+			return nil
 		}
 
-		ms.syncSector(target)
+		// add "next" sector; refresh new for combined
 
-		target = ShardSector{
-			Start: ms.sector.Start,
-			Ring:  r - 1,
-		}
+		for r := ShardSectorOuterRing; r > int(target.Ring); r-- {
+			sector = ShardSector{
+				Start: target.Start,
+				Ring:  uint(r - 1),
+			}
+
+			ms.syncSector(ShardSectorSet{sector.Split()[1]})
+			if !ms.addSector(sector, gen) {
+				return nil
+			}
 
-		newSync = ms.LHC.lastRefresh
-		ms.refreshSector(target, lastSync)
-		lastSync = newSync
+			newSync := ms.LHC.lastRefresh
+			ms.refreshSector(ms.currentSectors(), lastSync)
+			lastSync = newSync
+		}
 	}
 
-	ms.sector = target
 	ms.lastRefresh = lastSync
 
 	return nil
 }
 
+// addSector adds sector to the coverage unless the store is closed or the
+// targets are no longer generation gen
+func (ms *MessageStore) addSector(sector ShardSector, gen int) bool {
+	select {
+	case <-ms.done:
+		return false
+	default:
+	}
+	ms.sectorMutex.Lock()
+	defer ms.sectorMutex.Unlock()
+	if ms.targetGen != gen {
+		return false
+	}
+	ms.sectors = ms.sectors.Union(ShardSectorSet{sector})
+	return true
+}
+
+// queue queues a message to be downloaded from peers, waiting for room in
+// the queue. It returns false if the store is closed.
+func (ms *MessageStore) queue(I []byte) bool {
+	select {
+	case ms.iqueue <- I:
+		return true
+	case <-ms.done:
+		return false
+	}
+}
+
+// currentSectors returns the sectors the store currently holds, which grow
+// toward the targets as populate runs
+func (ms *MessageStore) currentSectors() ShardSectorSet {
+	ms.sectorMutex.Lock()
+	defer ms.sectorMutex.Unlock()
+	return ms.sectors
+}
+
 func (ms *MessageStore) SetTarget(target ShardSector) {
-	ms.target = target
-	ms.sector.Start = target.Start
-	ms.sector.Ring = ShardSectorOuterRing
+	ms.SetTargets(ShardSectorSet{target})
+}
 
-	go ms.populate(target.Ring)
+// SetTargets sets the sectors the store should hold. Coverage is rebuilt
+// from the outer ring sector at the start of each target. If the targets no
+// longer cover the previous targets the store contracts (see SetContraction).
+func (ms *MessageStore) SetTargets(targets ShardSectorSet) {
+	previous := ms.StoredTargets()
+	if previous == nil {
+		previous = ms.GetCurrentTargets()
+	}
+
+	ms.sectorMutex.Lock()
+	ms.targets = targets
+	ms.sectors = ShardSectorSet{}
+	ms.targetGen += 1
+	gen := ms.targetGen
+	ms.sectorMutex.Unlock()
+
+	err := ms.db.putMeta(targetsKey, []byte(targets.String()))
+	if err != nil {
+		fmt.Printf("MS: failed to record targets: %s\n", err)
+	}
+
+	ms.syncwg.Add(1)
+	go func() {
+		defer ms.syncwg.Done()
+		ms.populate(targets, gen)
+	}()
+	ms.startContraction(previous, targets, gen)
 }
 
+// GetCurrentTarget returns the first target sector
 func (ms *MessageStore) GetCurrentTarget() (target ShardSector) {
-	return ms.target
+	targets := ms.GetCurrentTargets()
+	if len(targets) == 0 {
+		return ShardSector{}
+	}
+	return targets[0]
+}
+
+func (ms *MessageStore) GetCurrentTargets() (targets ShardSectorSet) {
+	ms.sectorMutex.Lock()
+	defer ms.sectorMutex.Unlock()
+	return ms.targets
 }
 
 func (ms *MessageStore) Sync() (err error) {
@@ -623,7 +1300,7 @@ func (ms *MessageStore) Sync() (err error) {
 	lhc.Sync()
 	newSync := lhc.lastRefresh
 
-	ms.refreshSector(ms.sector, ms.lastRefresh)
+	ms.refreshSector(ms.currentSectors(), ms.lastRefresh)
 
 	ms.lastRefresh = newSync
 
@@ -640,19 +1317,21 @@ func (ms *MessageStore) RefreshStatus() (status string) {
 		status += "   MS: refresh "
 	}
 	status += time.Unix(int64(ms.lastRefresh), 0).UTC().Format("2006-01-02 15:04:05")
-	status += fmt.Sprintf(" (-%04ds) h: %d\n", (uint32(time.Now().Unix()) - ms.lastRefresh), ms.Count)
+	status += fmt.Sprintf(" (-%04ds) h: %d\n", (uint32(time.Now().Unix()) - ms.lastRefresh), ms.Count())
 	status += ms.LHC.RefreshStatus()
 	return status
 }
 
 func (ms *MessageStore) Status() (status *StatusResponse) {
+	ms.usedMutex.Lock()
 	r_storage := StatusStorageResponse{
 		Headers:     ms.LHC.Count,
-		Messages:    ms.Count,
-		Maxfilesize: (8 * 1024 * 1024),
-		Capacity:    (256 * 1024 * 1024 * 1024),
-		Used:        0,
+		Messages:    ms.count,
+		Maxfilesize: int(ms.maxFileSize),
+		Capacity:    int(ms.capacity),
+		Used:        int(ms.used),
 	}
+	ms.usedMutex.Unlock()
 
 	r_network := StatusNetworkResponse{
 		ms.ExternalHost,
@@ -660,18 +1339,19 @@ func (ms *MessageStore) Status() (status *StatusResponse) {
 		ms.ExtTokenPort,
 	}
 
-	r_target := ms.GetCurrentTarget()
-	r_sector := ShardSector{
-		Start: r_target.Start,
-		Ring:  r_target.Ring,
-	}
+	r_targets := ms.GetCurrentTargets()
+	r_sector := ms.GetCurrentTarget()
 
 	r_status := StatusResponse{
 		Network: r_network,
 		Pubkey:  ms.PubKey,
+		PoW:     ms.pow.Status(),
 		Storage: r_storage,
 		Sector:  r_sector,
 		Version: "0.2.0",
 	}
+	if len(r_targets) > 1 {
+		r_status.Sectors = r_targets
+	}
 	return &r_status
 }
@@ -28,21 +28,27 @@
 package ciphrtxt
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"testing"
 	//"math/big"
 	//"math/rand"
 	"io"
+	"io/ioutil"
 	"net/http"
-	//"io/ioutil"
 	//"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
-	//"encoding/json"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
 	"strconv"
-	//"sync"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/jadeblaquiere/cttd/btcec"
 )
 
 func TestMessageIngestMove(t *testing.T) {
@@ -82,9 +88,9 @@ func TestMessageIngestMove(t *testing.T) {
 		} else {
 			io.Copy(f, res.Body)
 			f.Close()
-			m := Ingest(filepath)
-			if m == nil {
-				fmt.Println("whoops: Ingest Failed!")
+			m, err := Ingest(filepath)
+			if err != nil {
+				fmt.Println("whoops: Ingest Failed!", err)
 				t.Fail()
 			} else {
 				Ihex := hex.EncodeToString(m.IKey())
@@ -116,6 +122,456 @@ func TestMessageIngestMove(t *testing.T) {
 	}
 }
 
+func TestNewMessageIngest(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	for _, l := range []int{0, 1, 187, 188, 189, 1000} {
+		ptxt := make([]byte, l)
+		rand.Read(ptxt)
+		m, err := NewMessage(priv.PubKey(), ptxt, time.Hour)
+		if err != nil {
+			fmt.Println("NewMessage failed:", err)
+			t.Fail()
+			continue
+		}
+		mb := m.Bytes()
+		if len(mb) != int(m.blocklen+1)*MessageHeaderLengthB64V2 {
+			fmt.Printf("message length %d does not match blocklen %d\n", len(mb), m.blocklen)
+			t.Fail()
+		}
+		mf, err := m.WriteFile(tmpdir + "/" + strconv.Itoa(l))
+		if err != nil {
+			fmt.Println("Ingest of composed message failed:", err)
+			t.Fail()
+			continue
+		}
+		if mf.Serialize() == nil || mf.RawMessageHeader.Serialize() != m.RawMessageHeader.Serialize() {
+			fmt.Println("Ingested header mismatch")
+			t.Fail()
+		}
+
+		if !mf.verified {
+			fmt.Println("Ingest did not verify composed message")
+			t.Fail()
+		}
+
+		// flip a byte in the body, Ingest records the signature failure
+		mb[len(mb)-1] ^= 0x01
+		err = ioutil.WriteFile(tmpdir+"/forged", mb, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged, err := Ingest(tmpdir + "/forged")
+		if err != nil {
+			fmt.Println("Ingest of forged message failed:", err)
+			t.Fail()
+			continue
+		}
+		if forged.verified {
+			fmt.Println("Ingest verified forged message")
+			t.Fail()
+		}
+		if _, ok := forged.Verify().(*SignatureError); !ok {
+			fmt.Println("forged message signature not rejected")
+			t.Fail()
+		}
+		d := sha256.Sum256(mb)
+		if !bytes.Equal(forged.Digest, d[:]) {
+			fmt.Println("forged message digest mismatch")
+			t.Fail()
+		}
+	}
+}
+
+// stallReader returns no data (and no error) on every other Read
+type stallReader struct {
+	r     io.Reader
+	stall bool
+}
+
+func (sr *stallReader) Read(p []byte) (n int, err error) {
+	sr.stall = !sr.stall
+	if sr.stall {
+		return 0, nil
+	}
+	return sr.r.Read(p)
+}
+
+func TestIngestReader(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	m, err := NewMessage(priv.PubKey(), make([]byte, 1000), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := m.Bytes()
+
+	mf, err := IngestReader(bytes.NewReader(mb), DefaultPoWPolicy, MaxMessageFileSize, tmpdir)
+	if err != nil {
+		fmt.Println("IngestReader failed:", err)
+		t.Fail()
+	} else {
+		fb, _ := ioutil.ReadFile(mf.Filepath)
+		if !bytes.Equal(fb, mb) || mf.Size != uint64(len(mb)) {
+			fmt.Println("IngestReader file contents mismatch")
+			t.Fail()
+		}
+		os.Remove(mf.Filepath)
+	}
+
+	badhdr := make([]byte, len(mb))
+	copy(badhdr, mb)
+	badhdr[10] ^= 0x01
+
+	cases := []struct {
+		data    []byte
+		pow     PoWPolicy
+		maxSize int64
+	}{
+		{mb, DefaultPoWPolicy, int64(len(mb) - 1)},
+		{mb[:len(mb)-4], DefaultPoWPolicy, MaxMessageFileSize},
+		{append(append([]byte{}, mb...), 'A'), DefaultPoWPolicy, MaxMessageFileSize},
+		{badhdr, DefaultPoWPolicy, MaxMessageFileSize},
+		{mb[:100], DefaultPoWPolicy, MaxMessageFileSize},
+		{mb, &FixedPoWPolicy{Bits: 64}, MaxMessageFileSize},
+	}
+	for n, c := range cases {
+		_, err = IngestReader(bytes.NewReader(c.data), c.pow, c.maxSize, tmpdir)
+		if err == nil {
+			fmt.Printf("IngestReader accepted bad message (case %d)\n", n)
+			t.Fail()
+		}
+		// readers which return no data without error, at any point
+		for _, stall := range []bool{false, true} {
+			_, serr := IngestReader(&stallReader{r: bytes.NewReader(c.data), stall: stall}, c.pow, c.maxSize, tmpdir)
+			if serr == nil {
+				fmt.Printf("IngestReader accepted bad message from stalling reader (case %d)\n", n)
+				t.Fail()
+			}
+		}
+		if (n == 0) && (err != ErrMessageTooLarge) {
+			fmt.Println("IngestReader oversize error:", err)
+			t.Fail()
+		}
+		files, _ := ioutil.ReadDir(tmpdir)
+		if len(files) != 0 {
+			fmt.Printf("IngestReader left %d files behind (case %d)\n", len(files), n)
+			t.Fail()
+		}
+	}
+}
+
+func TestMessageV3(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// one extension block and three extension blocks
+	extsets := [][]HeaderExtension{
+		{{HeaderExtContentClass, []byte("text/plain")}, {HeaderExtProtocolFlags, []byte{0x01}}},
+		{{HeaderExtPoWAlgorithm, []byte("sha256")}, {0x80, bytes.Repeat([]byte{0xA5}, 255)}, {0x81, bytes.Repeat([]byte{0x5A}, 255)}},
+	}
+
+	for n, ext := range extsets {
+		ptxt := []byte("extended header " + strconv.Itoa(n))
+		m, err := NewMessageWithExtensions(priv.PubKey(), ptxt, time.Hour, ext)
+		if err != nil {
+			fmt.Println("NewMessageWithExtensions failed:", err)
+			t.Fail()
+			continue
+		}
+		s := m.RawMessageHeader.Serialize()
+		if (len(s)%MessageHeaderLengthB64V2 != 0) || (len(s) == MessageHeaderLengthB64V2) {
+			fmt.Printf("V3 header length %d not a multiple of block size\n", len(s))
+			t.Fail()
+		}
+
+		// string, binary and websocket round trips
+		h := new(RawMessageHeader)
+		err = h.DeserializeStrict(s)
+		if err != nil {
+			fmt.Println("DeserializeStrict failed:", err)
+			t.Fail()
+			continue
+		}
+		if h.Serialize() != s || h.version != "0300" {
+			fmt.Println("V3 Serialize round trip mismatch")
+			t.Fail()
+		}
+		hb := new(RawMessageHeader)
+		err = hb.ImportBytesStrict(h.ExportBytes())
+		if err != nil || hb.Serialize() != s {
+			fmt.Println("V3 ExportBytes round trip failed:", err)
+			t.Fail()
+		}
+		wsm, err := DeserializeWSMessage(NewWSMessageHeaderResponse(h).SerializeMessage())
+		if err != nil {
+			fmt.Println("WSMessage deserialization failed:", err)
+			t.Fail()
+		} else if hw := wsm.DumpMessageHeader(); hw == nil || hw.Serialize() != s {
+			fmt.Println("V3 WSMessage round trip mismatch")
+			t.Fail()
+		}
+
+		hext, err := h.Extensions()
+		if err != nil || len(hext) != len(ext) {
+			fmt.Println("Extensions mismatch:", err)
+			t.Fail()
+			continue
+		}
+		for i := range ext {
+			if hext[i].Type != ext[i].Type || !bytes.Equal(hext[i].Value, ext[i].Value) {
+				fmt.Printf("Extension %d mismatch\n", i)
+				t.Fail()
+			}
+		}
+		j := h.JSON()
+		if j.Version != "0300" || len(j.Extensions) != len(ext) || j.Size != uint64(len(m.Bytes())) {
+			fmt.Println("V3 JSON mismatch")
+			t.Fail()
+		}
+
+		// Ingest, database record round trip and decrypt
+		mf, err := m.WriteFile(tmpdir + "/" + strconv.Itoa(n))
+		if err != nil {
+			fmt.Println("Ingest of V3 message failed:", err)
+			t.Fail()
+			continue
+		}
+		mfd := new(MessageFile).Deserialize(mf.Serialize())
+		if mfd == nil || mfd.RawMessageHeader.Serialize() != s || mfd.Filepath != mf.Filepath {
+			fmt.Println("V3 MessageFile record round trip mismatch")
+			t.Fail()
+		}
+		r, err := DecryptMessage(mf, priv)
+		if err != nil {
+			fmt.Println("DecryptMessage failed:", err)
+			t.Fail()
+			continue
+		}
+		dec, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(dec, ptxt) {
+			fmt.Println("V3 decrypted plaintext mismatch")
+			t.Fail()
+		}
+
+		// extensions are covered by the signature
+		mb := m.Bytes()
+		h.ext[len(h.ext)-1] ^= 0x01
+		if h.Verify(bytes.NewReader(mb[len(s):])) == nil {
+			fmt.Println("Verify accepted modified extension")
+			t.Fail()
+		}
+	}
+}
+
+func TestDecryptMessage(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	for _, l := range []int{0, 1, 188, 189, 10000} {
+		ptxt := make([]byte, l)
+		rand.Read(ptxt)
+		m, err := NewMessage(priv.PubKey(), ptxt, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mf, err := m.WriteFile(tmpdir + "/" + strconv.Itoa(l))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !mf.IsRecipient(priv) {
+			fmt.Println("IsRecipient false for recipient key")
+			t.Fail()
+		}
+		if mf.IsRecipient(other) {
+			fmt.Println("IsRecipient true for other key")
+			t.Fail()
+		}
+
+		_, err = DecryptMessage(mf, other)
+		if err != ErrNotRecipient {
+			fmt.Println("DecryptMessage with other key, expected ErrNotRecipient got", err)
+			t.Fail()
+		}
+
+		r, err := DecryptMessage(mf, priv)
+		if err != nil {
+			fmt.Println("DecryptMessage failed:", err)
+			t.Fail()
+			continue
+		}
+		dtxt, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			fmt.Println("error reading plaintext:", err)
+			t.Fail()
+		}
+		if !bytes.Equal(dtxt, ptxt) {
+			fmt.Printf("plaintext mismatch (len %d)\n", l)
+			t.Fail()
+		}
+	}
+
+	// a file shorter than its declared blocklen must not read as complete
+	ptxt := make([]byte, 10000)
+	rand.Read(ptxt)
+	m, err := NewMessage(priv.PubKey(), ptxt, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf, err := m.WriteFile(tmpdir + "/truncated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(mf.Filepath, int64(len(m.Bytes())-(2*MessageHeaderLengthB64V2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := DecryptMessage(mf, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dtxt, err := ioutil.ReadAll(r)
+	r.Close()
+	if (err != io.ErrUnexpectedEOF) || (len(dtxt) >= len(ptxt)) {
+		fmt.Println("truncated message read", len(dtxt), "bytes, error", err)
+		t.Fail()
+	}
+}
+
+func TestMessageScrub(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lhc, err := OpenLocalHeaderCache(tmpdir + "/headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+
+	ms, err := OpenMessageStore(tmpdir+"/messages", lhc, 0x200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+
+	msgs := make([]*MessageFile, 0)
+	for i := 0; i < 4; i++ {
+		m, err := NewMessage(priv.PubKey(), []byte("scrub "+strconv.Itoa(i)), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mf, err := IngestReader(m.Reader(), DefaultPoWPolicy, MaxMessageFileSize, tmpdir+"/messages/receive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		Ihex := hex.EncodeToString(mf.I)
+		err = mf.Move(tmpdir + "/messages/store/" + Ihex[:4] + "/" + Ihex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ms.Insert(mf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, mf)
+	}
+
+	// digest is persisted in the database record
+	for _, mf := range msgs {
+		m, err := ms.FindByI(mf.I)
+		if err != nil || !bytes.Equal(m.Digest, mf.Digest) || len(m.Digest) == 0 {
+			fmt.Println("message digest not persisted")
+			t.Fail()
+		}
+	}
+
+	bad, err := ms.Scrub()
+	if err != nil || bad != 0 {
+		fmt.Printf("Scrub of clean store found %d bad messages (%v)\n", bad, err)
+		t.Fail()
+	}
+
+	// corrupt the last byte of one message body
+	fb, err := ioutil.ReadFile(msgs[1].Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb[len(fb)-1] ^= 0x01
+	err = ioutil.WriteFile(msgs[1].Filepath, fb, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad, err = ms.Scrub()
+	if err != nil || bad != 1 {
+		fmt.Printf("Scrub found %d bad messages, expected 1 (%v)\n", bad, err)
+		t.Fail()
+	}
+	_, err = ms.FindByI(msgs[1].I)
+	if err == nil {
+		fmt.Println("corrupted message still in store")
+		t.Fail()
+	}
+	_, err = os.Stat(tmpdir + "/messages/quarantine/" + hex.EncodeToString(msgs[1].I))
+	if err != nil {
+		fmt.Println("corrupted message not quarantined:", err)
+		t.Fail()
+	}
+	if ms.Count() != 3 {
+		fmt.Printf("message count %d after quarantine, expected 3\n", ms.Count())
+		t.Fail()
+	}
+}
+
 func TestOpenMessageStore(t *testing.T) {
 	lhc, err := OpenLocalHeaderCache("headers")
 	if err != nil {
@@ -136,8 +592,8 @@ func TestOpenMessageStore(t *testing.T) {
 
 	ms.pruneExpired()
 
-	lhc.addPeer("indigo.ciphrtxt.com", 7754)
-	lhc.addPeer("violet.ciphrtxt.com", 7754)
+	lhc.AddPeer("indigo.ciphrtxt.com", 7754)
+	lhc.AddPeer("violet.ciphrtxt.com", 7754)
 
 	lhc.Sync()
 
@@ -177,8 +633,8 @@ func TestFindOrFetch(t *testing.T) {
 
 	ms.pruneExpired()
 
-	lhc.addPeer("indigo.ciphrtxt.com", 7754)
-	lhc.addPeer("violet.ciphrtxt.com", 7754)
+	lhc.AddPeer("indigo.ciphrtxt.com", 7754)
+	lhc.AddPeer("violet.ciphrtxt.com", 7754)
 
 	lhc.Sync()
 
@@ -220,3 +676,946 @@ func TestFindOrFetch(t *testing.T) {
 		}
 	}
 }
+
+func TestMessageStoreQuota(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir+"/headers", NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetSeedPeers(nil)
+
+	ms, err := OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+
+	newFile := func(ttl time.Duration) *MessageFile {
+		m, err := NewMessage(priv.PubKey(), []byte("quota"), ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mf, err := IngestReader(m.Reader(), DefaultPoWPolicy, MaxMessageFileSize, tmpdir+"/messages/receive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		Ihex := hex.EncodeToString(mf.I)
+		err = mf.Move(tmpdir + "/messages/store/" + Ihex[:4] + "/" + Ihex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mf
+	}
+
+	first := newFile(time.Hour)
+	size := first.fileSize()
+
+	// too large for the configured maximum
+	ms.SetQuota(100*size, size-1)
+	_, err = ms.Insert(first)
+	if err != ErrMessageTooLarge {
+		fmt.Println("oversize message accepted:", err)
+		t.Fail()
+	}
+
+	// room for 10 messages, the soonest expiring are evicted first
+	ms.SetQuota(10*size, size)
+	ms.SetEvictionPolicy(&SoonestExpiringEviction{})
+	_, err = ms.Insert(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 9; i++ {
+		_, err = ms.Insert(newFile(time.Duration(2+i) * time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if (ms.Count() != 9) || (ms.Used() != 9*size) {
+		fmt.Printf("count %d used %d, expected 9, %d\n", ms.Count(), ms.Used(), 9*size)
+		t.Fail()
+	}
+
+	// the 10th message passes the high water mark
+	_, err = ms.Insert(newFile(24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms.Used() > 9*size {
+		fmt.Printf("used %d after eviction, expected at most %d\n", ms.Used(), 9*size)
+		t.Fail()
+	}
+	_, err = ms.FindByI(first.I)
+	if err == nil {
+		fmt.Println("soonest expiring message not evicted")
+		t.Fail()
+	}
+	_, err = os.Stat(first.Filepath)
+	if !os.IsNotExist(err) {
+		fmt.Println("evicted message file not removed")
+		t.Fail()
+	}
+
+	st := ms.Status()
+	if (st.Storage.Used != int(ms.Used())) || (st.Storage.Capacity != int(10*size)) || (st.Storage.Maxfilesize != int(size)) {
+		fmt.Println("status does not report quota")
+		t.Fail()
+	}
+
+	// concurrent inserts of the same message are counted once
+	ms.SetQuota(100*size, size)
+	count, used := ms.Count(), ms.Used()
+	dups := make([]*MessageFile, 8)
+	for i := range dups {
+		dups[i] = newFile(48 * time.Hour)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < syncMaxGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, mf := range dups {
+				ms.Insert(mf)
+			}
+		}()
+	}
+	wg.Wait()
+	n := len(dups)
+	if (ms.Count() != count+n) || (ms.Used() != used+int64(n)*size) {
+		fmt.Printf("count %d used %d after concurrent inserts, expected %d, %d\n", ms.Count(), ms.Used(), count+n, used+int64(n)*size)
+		t.Fail()
+	}
+}
+
+func TestMessageStoreRequireSignatures(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir+"/headers", NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetSeedPeers(nil)
+
+	ms, err := OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+
+	// body modified after signing, the signature no longer verifies
+	forged := func() *MessageFile {
+		m, err := NewMessage(priv.PubKey(), []byte("forged"), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mb := m.Bytes()
+		mb[len(mb)-1] ^= 0x01
+		mf, err := IngestReader(bytes.NewReader(mb), DefaultPoWPolicy, MaxMessageFileSize, tmpdir+"/messages/receive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mf.verified {
+			fmt.Println("IngestReader verified forged message")
+			t.Fail()
+		}
+		return mf
+	}
+
+	accepted := forged()
+	_, err = ms.Store(accepted)
+	if err != nil {
+		fmt.Println("forged message rejected without RequireSignatures:", err)
+		t.Fail()
+	}
+
+	ms.SetRequireSignatures(true)
+	rejected := forged()
+	_, err = ms.Store(rejected)
+	if _, ok := err.(*SignatureError); !ok {
+		fmt.Println("forged message not rejected with RequireSignatures:", err)
+		t.Fail()
+	}
+	if ms.db.has(rejected.I) || (ms.Count() != 1) {
+		fmt.Println("rejected message left a record")
+		t.Fail()
+	}
+}
+
+func TestMessageStoreFsck(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir+"/headers", NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetSeedPeers(nil)
+
+	kv := NewMemKVStore()
+	ms, err := OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() *MessageFile {
+		m, err := NewMessage(priv.PubKey(), []byte("fsck"), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mf, err := IngestReader(m.Reader(), DefaultPoWPolicy, MaxMessageFileSize, tmpdir+"/messages/receive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mf
+	}
+
+	msgs := make([]*MessageFile, 0)
+	for i := 0; i < 4; i++ {
+		mf := receive()
+		_, err = ms.Store(mf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, mf)
+	}
+
+	// storing a message again keeps the stored file and record
+	stored, err := os.Stat(msgs[1].Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(msgs[1].Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup, err := IngestReader(bytes.NewReader(data), DefaultPoWPolicy, MaxMessageFileSize, tmpdir+"/messages/receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servertime, err := ms.Store(dup)
+	if (err != nil) || (servertime != msgs[1].Servertime) {
+		fmt.Println("duplicate Store returned", servertime, err)
+		t.Fail()
+	}
+	after, err := os.Stat(msgs[1].Filepath)
+	if (err != nil) || !os.SameFile(stored, after) {
+		fmt.Println("duplicate Store replaced the stored file")
+		t.Fail()
+	}
+	_, err = os.Stat(dup.Filepath)
+	if !os.IsNotExist(err) {
+		fmt.Println("duplicate Store left the received file")
+		t.Fail()
+	}
+
+	// a failed Store leaves neither a record nor a file
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 64})
+	failed := receive()
+	_, err = ms.Store(failed)
+	if err == nil {
+		fmt.Println("Store accepted header rejected by the header cache")
+		t.Fail()
+	}
+	if ms.db.has(failed.I) || (ms.Count() != len(msgs)) {
+		fmt.Println("failed Store left a record")
+		t.Fail()
+	}
+	lhc.SetPoWPolicy(DefaultPoWPolicy)
+
+	report, err := ms.Fsck(false)
+	if err != nil || report.Problems() != 0 || report.Files != 4 || report.Records != 4 {
+		fmt.Println("fsck of clean store:", report, err)
+		t.Fail()
+	}
+
+	// file in store without a record
+	orphan := receive()
+	Ihex := hex.EncodeToString(orphan.I)
+	err = orphan.Move(tmpdir + "/messages/store/" + Ihex[:4] + "/" + Ihex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// record without a file
+	os.Remove(msgs[0].Filepath)
+	// junk in store and an old file in receive
+	ioutil.WriteFile(tmpdir+"/messages/store/0200/junk", []byte("junk"), 0644)
+	stale := receive()
+	old := time.Now().Add(-2 * fsckReceiveAge * time.Second)
+	os.Chtimes(stale.Filepath, old, old)
+	// interrupted Store, moved but not indexed
+	pending := receive()
+	e := &journalEntry{op: journalInsert, path: tmpdir + "/messages/store/" + hex.EncodeToString(pending.I)[:4] + "/" + hex.EncodeToString(pending.I)}
+	ms.db.putJournal(pending.I, e.serialize())
+	pending.Move(e.path)
+
+	report, err = ms.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(report.OrphanFiles) != 1) || (len(report.OrphanRecords) != 1) || (len(report.BadFiles) != 1) || (len(report.StaleReceive) != 1) || (len(report.Journal) != 1) {
+		fmt.Println("fsck report mismatch:")
+		fmt.Println(report)
+		t.Fail()
+	}
+
+	// a store opened for fsck reports the same problems, without recovering
+	// the interrupted Store or changing the checkpoint
+	ms.Close()
+	ms, err = OpenMessageStoreFsckKV(tmpdir+"/messages", lhc, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err := ms.db.getMeta([]byte("\000\000\000\000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsckReport, err := ms.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsckReport.String() != report.String() {
+		fmt.Println("fsck open report mismatch:")
+		fmt.Println(fsckReport)
+		t.Fail()
+	}
+	unchanged, err := ms.db.getMeta([]byte("\000\000\000\000"))
+	if err != nil || !bytes.Equal(unchanged, checkpoint) || !ms.db.hasJournal(pending.I) {
+		fmt.Println("fsck check changed the store")
+		t.Fail()
+	}
+
+	report, err = ms.Fsck(true)
+	if err != nil || report.Repaired != report.Problems() {
+		fmt.Println("fsck repair incomplete:", report, err)
+		t.Fail()
+	}
+	report, err = ms.Fsck(false)
+	if err != nil || report.Problems() != 0 {
+		fmt.Println("fsck after repair:", report, err)
+		t.Fail()
+	}
+	for _, m := range []*MessageFile{orphan, pending} {
+		_, err = ms.FindByI(m.I)
+		if err != nil {
+			fmt.Println("orphan message not indexed by repair")
+			t.Fail()
+		}
+	}
+	if ms.Count() != 5 {
+		fmt.Println("count after repair", ms.Count(), "expected 5")
+		t.Fail()
+	}
+
+	// repair waits for a Store in progress (holding opMutex) rather than
+	// recovering its journal entry
+	inflight := receive()
+	Ihex = hex.EncodeToString(inflight.I)
+	e = &journalEntry{op: journalInsert, path: tmpdir + "/messages/store/" + Ihex[:4] + "/" + Ihex, src: inflight.Filepath}
+	ms.opMutex.RLock()
+	ms.db.putJournal(inflight.I, e.serialize())
+	fsckDone := make(chan *FsckReport)
+	go func() {
+		r, err := ms.Fsck(true)
+		if err != nil {
+			fmt.Println("fsck during Store failed:", err)
+		}
+		fsckDone <- r
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-fsckDone:
+		fmt.Println("fsck did not wait for Store in progress")
+		t.Fail()
+	default:
+	}
+	err = inflight.Move(e.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ms.Insert(inflight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.db.clearJournal(inflight.I)
+	ms.opMutex.RUnlock()
+	report = <-fsckDone
+	if (report == nil) || (report.Problems() != 0) || (ms.Count() != 6) {
+		fmt.Println("fsck after Store in progress:", report, ms.Count())
+		t.Fail()
+	}
+
+	// interrupted Remove is completed on open
+	e = &journalEntry{op: journalRemove, path: msgs[1].Filepath}
+	ms.db.putJournal(msgs[1].I, e.serialize())
+	ms.Close()
+
+	ms, err = OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	_, err = ms.FindByI(msgs[1].I)
+	if err == nil {
+		fmt.Println("interrupted remove not completed")
+		t.Fail()
+	}
+	_, err = os.Stat(msgs[1].Filepath)
+	if !os.IsNotExist(err) {
+		fmt.Println("interrupted remove left file")
+		t.Fail()
+	}
+}
+
+func TestMessageStoreCheckpoint(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir+"/headers", NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetSeedPeers(nil)
+
+	kv := NewMemKVStore()
+	ms, err := OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() *MessageFile {
+		m, err := NewMessage(priv.PubKey(), []byte("checkpoint"), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mf, err := IngestReader(m.Reader(), DefaultPoWPolicy, MaxMessageFileSize, tmpdir+"/messages/receive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mf
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = ms.Store(receive())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := ms.Used()
+	ms.Close()
+
+	// unindexed file, not found after a clean shutdown until Rescan
+	unindexed := receive()
+	Ihex := hex.EncodeToString(unindexed.I)
+	unindexed.Move(tmpdir + "/messages/store/" + Ihex[:4] + "/" + Ihex)
+
+	ms, err = OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (ms.Count() != 3) || (ms.Used() != used) {
+		fmt.Printf("checkpoint count %d used %d, expected 3, %d\n", ms.Count(), ms.Used(), used)
+		t.Fail()
+	}
+	n, err := ms.Rescan()
+	if err != nil || n != 1 || ms.Count() != 4 {
+		fmt.Printf("Rescan inserted %d, count %d (%v)\n", n, ms.Count(), err)
+		t.Fail()
+	}
+	ms.Close()
+
+	// without a clean checkpoint (as after a crash) the store is scanned
+	kv.Put([]byte("\000\000\000\000"), make([]byte, 17))
+	unindexed = receive()
+	Ihex = hex.EncodeToString(unindexed.I)
+	unindexed.Move(tmpdir + "/messages/store/" + Ihex[:4] + "/" + Ihex)
+
+	ms, err = OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	if ms.Count() != 5 {
+		fmt.Printf("count after unclean open %d, expected 5\n", ms.Count())
+		t.Fail()
+	}
+
+	// messages stored (e.g. downloaded) during Rescan are counted once
+	for i := 0; i < 4; i++ {
+		unindexed = receive()
+		Ihex = hex.EncodeToString(unindexed.I)
+		unindexed.Move(tmpdir + "/messages/store/" + Ihex[:4] + "/" + Ihex)
+	}
+	stored := make([]*MessageFile, 8)
+	for i := range stored {
+		stored[i] = receive()
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(stored))
+	for _, mf := range stored {
+		go func(mf *MessageFile) {
+			defer wg.Done()
+			ms.Store(mf)
+		}(mf)
+	}
+	_, err = ms.Rescan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	count, used := ms.Count(), ms.Used()
+	err = ms.recount()
+	if err != nil || (count != 17) || (ms.Count() != count) || (ms.Used() != used) {
+		fmt.Printf("count %d used %d after Rescan, recount %d %d\n", count, used, ms.Count(), ms.Used())
+		t.Fail()
+	}
+}
+
+func TestMessageStoreTimeRange(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir+"/headers", NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetSeedPeers(nil)
+
+	kv := NewMemKVStore()
+	ms, err := OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		m, err := NewMessage(priv.PubKey(), []byte("time range"), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mf, err := IngestReader(m.Reader(), DefaultPoWPolicy, MaxMessageFileSize, tmpdir+"/messages/receive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ms.Store(mf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := uint32(time.Now().Unix())
+	msgs, err := ms.FindByTimeRange(now-60, now+60)
+	if (err != nil) || (len(msgs) != 3) {
+		fmt.Println("FindByTimeRange returned", len(msgs), "messages")
+		t.Fail()
+	}
+	msgs, _ = ms.FindByTimeRange(0, now-60)
+	if len(msgs) != 0 {
+		fmt.Println("FindByTimeRange returned messages before range")
+		t.Fail()
+	}
+	ms.Close()
+
+	// a store without the date index (as created by older versions) has
+	// the index built on open
+	batch := new(KVBatch)
+	iter := kv.NewIterator([]byte{indexPrefixDate}, []byte{indexPrefixDate + 1})
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	batch.Delete(dateIndexKey)
+	kv.Write(batch)
+
+	ms, err = OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	msgs, err = ms.FindByTimeRange(now-60, now+60)
+	if (err != nil) || (len(msgs) != 3) {
+		fmt.Println("FindByTimeRange after upgrade returned", len(msgs), "messages")
+		t.Fail()
+	}
+}
+
+func TestMessageStoreSectors(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir+"/headers", NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetSeedPeers(nil)
+
+	ms, err := OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+
+	targets, err := ParseShardSectorSet("3f0/5,280/6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.sectorMutex.Lock()
+	ms.targets = targets
+	ms.sectors = ShardSectorSet{}
+	ms.sectorMutex.Unlock()
+	ms.populate(targets, ms.targetGen)
+
+	if ms.currentSectors().String() != targets.String() {
+		fmt.Println("populated", ms.currentSectors(), "expected", targets)
+		t.Fail()
+	}
+
+	// peers see every sector in the status
+	b, err := json.Marshal(ms.Status())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status StatusResponse
+	err = json.Unmarshal(b, &status)
+	if (err != nil) || (status.SectorSet().String() != targets.String()) || (status.Sector != targets[0]) {
+		fmt.Println("status advertised", status.Sector, status.SectorSet())
+		t.Fail()
+	}
+
+	// older peers only advertise a single sector
+	status.Sectors = nil
+	if status.SectorSet().String() != targets[0].String() {
+		fmt.Println("single sector status advertised", status.SectorSet())
+		t.Fail()
+	}
+	status.Sector = ShardSector{Start: 0, Ring: 10}
+	if len(status.SectorSet()) != 0 {
+		fmt.Println("header only status advertised", status.SectorSet())
+		t.Fail()
+	}
+
+	inside := &MessageFile{RawMessageHeader: RawMessageHeader{I: []byte{0x02, 0x81}}}
+	outside := &MessageFile{RawMessageHeader: RawMessageHeader{I: []byte{0x03, 0x00}}}
+	if !DefaultEvictionPolicy.Less(outside, inside, ms.GetCurrentTargets()) {
+		fmt.Println("eviction prefers messages inside the second sector")
+		t.Fail()
+	}
+}
+
+func TestMessageStoreContraction(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir+"/headers", NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetSeedPeers(nil)
+
+	kv := NewMemKVStore()
+	ms, err := OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.SetContraction(time.Hour, 1)
+	ms.SetTarget(ShardSector{Start: 0x200, Ring: 0})
+
+	msgs := make([]*MessageFile, 0)
+	for len(msgs) < 3 {
+		m, err := NewMessage(priv.PubKey(), []byte("contraction"), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mf, err := IngestReader(m.Reader(), DefaultPoWPolicy, MaxMessageFileSize, tmpdir+"/messages/receive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// keep the messages in distinct bins
+		bin := ShardSector{Start: int(binary.BigEndian.Uint16(mf.I[:2])), Ring: ShardSectorOuterRing}
+		distinct := true
+		for _, o := range msgs {
+			if bin.Contains(o.I) {
+				distinct = false
+			}
+		}
+		if !distinct {
+			os.Remove(mf.Filepath)
+			continue
+		}
+		_, err = ms.Store(mf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, mf)
+	}
+	keep := ShardSector{Start: int(binary.BigEndian.Uint16(msgs[0].I[:2])), Ring: ShardSectorOuterRing}
+
+	// nothing is evicted during the grace period, which survives a restart
+	ms.SetTarget(keep)
+	if ms.Count() != 3 {
+		fmt.Println("evicted during grace period, count", ms.Count())
+		t.Fail()
+	}
+	since, err := kv.Get(contractKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.Close()
+	ms, err = OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.SetContraction(time.Hour, 1)
+	ms.SetTarget(keep)
+	time.Sleep(200 * time.Millisecond)
+	if ms.Count() != 3 {
+		fmt.Println("evicted during grace period after restart, count", ms.Count())
+		t.Fail()
+	}
+	resumed, err := kv.Get(contractKey)
+	if (err != nil) || !bytes.Equal(resumed, since) {
+		fmt.Println("contraction start not kept across restart")
+		t.Fail()
+	}
+	ms.Close()
+
+	// the grace period runs from the recorded start, not from the restart
+	kv.Put(contractKey, serializeUint32(deserializeUint32(since)-3600))
+	ms, err = OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { ms.Close() }()
+	ms.SetContraction(time.Hour, 1)
+	ms.SetTarget(keep)
+
+	// evicted one message per second
+	deadline := time.Now().Add(10 * time.Second)
+	for (ms.Count() > 1) && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if ms.Count() != 1 {
+		fmt.Println("contraction left", ms.Count(), "messages")
+		t.Fail()
+	}
+	_, err = ms.FindByI(msgs[0].I)
+	if err != nil {
+		fmt.Println("contraction evicted message inside target")
+		t.Fail()
+	}
+	for ms.db.has(contractKey) && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if ms.db.has(contractKey) {
+		fmt.Println("contraction not cleared")
+		t.Fail()
+	}
+}
+
+func TestMessageStoreAutoSize(t *testing.T) {
+	// 1 MiB per bin in 100 MiB, ring 3 (64 bins) fills 64%
+	if (autoRing(ShardSectorOuterRing, 1<<20, 100<<20) != 4) || (autoRing(2, 1<<20, 100<<20) != 3) {
+		fmt.Println("autoRing out of range")
+		t.Fail()
+	}
+	if autoRing(ShardSectorOuterRing, 0, 100<<20) != 0 {
+		fmt.Println("autoRing with no messages not ring 0")
+		t.Fail()
+	}
+
+	rep := make([]int, ShardNBins)
+	for i := 0; i < 0x100; i++ {
+		rep[i] = 2
+	}
+	if s := autoStart(rep, 64, 0x200); s != 0x3c0 {
+		fmt.Printf("autoStart moved to %03x, expected 3c0\n", s)
+		t.Fail()
+	}
+	rep = make([]int, ShardNBins)
+	rep[0x10] = 1
+	if s := autoStart(rep, 64, 0x200); s != 0x200 {
+		fmt.Printf("autoStart moved to %03x for a marginal gain\n", s)
+		t.Fail()
+	}
+
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lhc, err := OpenLocalHeaderCacheKV(tmpdir+"/headers", NewMemKVStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lhc.Close()
+	lhc.SetSeedPeers(nil)
+	lhc.SetPoWPolicy(&FixedPoWPolicy{Bits: 0})
+	hdrs := benchHeaders(100)
+	for i := range hdrs {
+		lhc.Insert(&hdrs[i])
+	}
+
+	// a peer holding half the circle (with no headers, so that download
+	// goroutines find nothing to fetch from it)
+	lhc.lastRefresh = uint32(time.Now().Unix())
+	lhc.Peers = append(lhc.Peers, &peerCache{
+		HC: &HeaderCache{
+			status: StatusResponse{Sector: ShardSector{Start: 0x200, Ring: 1}},
+			db:     NewHeaderIndex(NewMemKVStore(), true),
+		},
+	})
+
+	kv := NewMemKVStore()
+	ms, err := OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms.StoredTargets() != nil {
+		fmt.Println("stored targets before any were set")
+		t.Fail()
+	}
+	ms.SetTarget(ShardSector{Start: 0x200, Ring: ShardSectorOuterRing})
+
+	// a capacity which fits ring 2
+	perBin, err := ms.binUsage()
+	if err != nil || perBin == 0 {
+		t.Fatal("binUsage failed:", err)
+	}
+	ms.SetQuota(perBin*250, MaxMessageFileSize)
+
+	changed, err := ms.AutoSize()
+	if err != nil || !changed {
+		fmt.Println("AutoSize did not retarget", err)
+		t.Fail()
+	}
+	if ms.GetCurrentTarget() != (ShardSector{Start: 0x380, Ring: 2}) {
+		fmt.Println("AutoSize target", ms.GetCurrentTarget(), "expected 380/2")
+		t.Fail()
+	}
+	changed, _ = ms.AutoSize()
+	if changed {
+		fmt.Println("AutoSize retargeted without change")
+		t.Fail()
+	}
+
+	// the automatic target is kept for a restart to resume
+	ms.Close()
+	ms, err = OpenMessageStoreKV(tmpdir+"/messages", lhc, 0x200, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	stored := ms.StoredTargets()
+	if (len(stored) != 1) || (stored[0] != ShardSector{Start: 0x380, Ring: 2}) {
+		fmt.Println("stored targets", stored, "expected 380/2")
+		t.Fail()
+	}
+}
+
+func TestNodeKey(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ciphrtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	priv, err := LoadOrCreateNodeKey(tmpdir + "/nodekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadOrCreateNodeKey(tmpdir + "/nodekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(priv.PubKey().SerializeCompressed(), again.PubKey().SerializeCompressed()) {
+		fmt.Println("node key not persistent")
+		t.Fail()
+	}
+	finfo, err := os.Stat(tmpdir + "/nodekey")
+	if (err != nil) || (finfo.Mode().Perm() != 0600) {
+		fmt.Println("node key file mode", finfo.Mode())
+		t.Fail()
+	}
+
+	bin := NodeStartBin(priv.PubKey())
+	if (bin < ShardBaseVal) || (bin >= ShardMaxVal) || (bin != NodeStartBin(again.PubKey())) {
+		fmt.Printf("start bin %03x\n", bin)
+		t.Fail()
+	}
+
+	badkeys := []string{
+		"not a key",
+		hex.EncodeToString(make([]byte, 32)),
+		hex.EncodeToString(btcec.S256().N.Bytes()),
+		strings.Repeat("ff", 32),
+	}
+	for _, k := range badkeys {
+		ioutil.WriteFile(tmpdir+"/badkey", []byte(k), 0600)
+		_, err = LoadOrCreateNodeKey(tmpdir + "/badkey")
+		if err == nil {
+			fmt.Println("loaded invalid node key", k)
+			t.Fail()
+		}
+	}
+}
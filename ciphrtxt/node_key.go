@@ -0,0 +1,93 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jadeblaquiere/cttd/btcec"
+)
+
+// LoadOrCreateNodeKey reads the node private key (hex) from path, creating
+// a new key if the file does not exist. The node public key is advertised
+// in StatusResponse.Pubkey and determines the node's start bin.
+func LoadOrCreateNodeKey(path string) (priv *btcec.PrivateKey, err error) {
+	curve := btcec.S256()
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		b, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(b) != 32 {
+			return nil, errors.New("invalid node key file " + path)
+		}
+		priv, _ = btcec.PrivKeyFromBytes(curve, b)
+		if !validNodeKey(priv) {
+			return nil, errors.New("node key out of range in " + path)
+		}
+		return priv, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	for {
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		priv, _ = btcec.PrivKeyFromBytes(curve, b)
+		if validNodeKey(priv) {
+			break
+		}
+	}
+	err = ioutil.WriteFile(path, []byte(hex.EncodeToString(b)+"\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// validNodeKey rejects 0 and values beyond the group order
+func validNodeKey(priv *btcec.PrivateKey) bool {
+	return (priv.D.Sign() > 0) && (priv.D.Cmp(btcec.S256().N) < 0)
+}
+
+// NodeStartBin derives a node's start bin from its public key, so that a
+// node returns to the same sector on restart and peers can check the
+// sector a node advertises against its key
+func NodeStartBin(pub *btcec.PublicKey) int {
+	h := sha256.Sum256(pub.SerializeCompressed())
+	return ShardBaseVal + int(binary.BigEndian.Uint16(h[:2]))%ShardNBins
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPeerPort is used for seed addresses given without a port
+const DefaultPeerPort = 7754
+
+// peers are retried after a failure with exponential backoff, up to a day
+const peerBookRetryBase = 60
+const peerBookRetryMax = (24 * 3600)
+
+// peers which have failed this many times in a row and have not been
+// reached for peerBookExpire seconds are dropped from the book
+const peerBookMaxFailures = 16
+const peerBookExpire = (14 * 24 * 3600)
+
+// peers learned by gossip which have never been reached are dropped after
+// this many failures, as anyone can submit addresses
+const peerBookGossipMaxFailures = 3
+
+// the book keeps at most this many peers, dropping the least recently
+// successful
+const peerBookMaxSize = 1024
+
+// maximum number of connections attempted to book peers in one Sync
+const peerBookMaxAttempts = 16
+
+// number of connected peers below which Sync bootstraps from the book
+const lhcTargetPeers = 8
+
+// PeerSource records how a peer address was learned
+type PeerSource uint8
+
+const (
+	PeerSourceUnknown PeerSource = iota
+	// PeerSourceSeed is a seed address (see SetSeedPeers)
+	PeerSourceSeed
+	// PeerSourceManual is configured by the operator
+	PeerSourceManual
+	// PeerSourceGossip is learned from another peer
+	PeerSourceGossip
+	// PeerSourceInbound connected to us
+	PeerSourceInbound
+)
+
+func (s PeerSource) String() string {
+	switch s {
+	case PeerSourceSeed:
+		return "seed"
+	case PeerSourceManual:
+		return "manual"
+	case PeerSourceGossip:
+		return "gossip"
+	case PeerSourceInbound:
+		return "inbound"
+	}
+	return "unknown"
+}
+
+// PeerRecord is the peer book entry for a peer address. Times are unix
+// seconds, Failures counts consecutive failed connection attempts.
+type PeerRecord struct {
+	Host        string
+	Port        uint16
+	Source      PeerSource
+	FirstSeen   uint32
+	LastSuccess uint32
+	LastFailure uint32
+	Failures    uint32
+}
+
+// peer book records are stored in the local header cache database under
+// 00000002 || host:port
+var peerBookPrefix = []byte("\000\000\000\002")
+
+func peerBookKey(host string, port uint16) []byte {
+	return append(append([]byte{}, peerBookPrefix...), []byte(net.JoinHostPort(host, strconv.Itoa(int(port))))...)
+}
+
+func (r *PeerRecord) serialize() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(r.Source))
+	binary.Write(buf, binary.BigEndian, r.FirstSeen)
+	binary.Write(buf, binary.BigEndian, r.LastSuccess)
+	binary.Write(buf, binary.BigEndian, r.LastFailure)
+	binary.Write(buf, binary.BigEndian, r.Failures)
+	return buf.Bytes()
+}
+
+func (r *PeerRecord) deserialize(key []byte, value []byte) (err error) {
+	if len(value) != 17 {
+		return errors.New("peer record length mismatch")
+	}
+	host, port, err := ParsePeerAddress(string(key[len(peerBookPrefix):]))
+	if err != nil {
+		return err
+	}
+	r.Host = host
+	r.Port = port
+	r.Source = PeerSource(value[0])
+	r.FirstSeen = binary.BigEndian.Uint32(value[1:5])
+	r.LastSuccess = binary.BigEndian.Uint32(value[5:9])
+	r.LastFailure = binary.BigEndian.Uint32(value[9:13])
+	r.Failures = binary.BigEndian.Uint32(value[13:17])
+	return nil
+}
+
+// expired returns true if the peer should be dropped from the book
+func (r *PeerRecord) expired(now uint32) bool {
+	if (r.Source == PeerSourceGossip) && (r.LastSuccess == 0) && (r.Failures >= peerBookGossipMaxFailures) {
+		return true
+	}
+	return (r.Failures >= peerBookMaxFailures) && ((r.LastSuccess + peerBookExpire) < now)
+}
+
+// retryAfter returns the time after which a connection may be attempted
+func (r *PeerRecord) retryAfter() uint32 {
+	if r.Failures == 0 {
+		return 0
+	}
+	delay := uint32(peerBookRetryMax)
+	if r.Failures < 12 {
+		delay = peerBookRetryBase << r.Failures
+		if delay > peerBookRetryMax {
+			delay = peerBookRetryMax
+		}
+	}
+	return r.LastFailure + delay
+}
+
+// ParsePeerAddress parses "host:port" or "host" (using DefaultPeerPort).
+// IPv6 addresses with a port must be in brackets, e.g. "[::1]:7754".
+func ParsePeerAddress(s string) (host string, port uint16, err error) {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return s[1 : len(s)-1], DefaultPeerPort, nil
+	}
+	if !strings.HasPrefix(s, "[") && (strings.Count(s, ":") != 1) {
+		return s, DefaultPeerPort, nil
+	}
+	host, ps, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.ParseUint(ps, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in peer address %s", s)
+	}
+	return host, uint16(p), nil
+}
+
+// SetSeedPeers sets the addresses ("host:port") used to bootstrap when no
+// peers in the peer book can be reached. An empty list disables seeding,
+// e.g. for private networks.
+func (lhc *LocalHeaderCache) SetSeedPeers(seeds []string) (err error) {
+	pcs := make([]*peerCandidate, 0, len(seeds))
+	for _, s := range seeds {
+		host, port, err := ParsePeerAddress(s)
+		if err != nil {
+			return err
+		}
+		pcs = append(pcs, &peerCandidate{host: host, port: port, source: PeerSourceSeed})
+	}
+	lhc.peerCandidateMutex.Lock()
+	lhc.seedPeers = pcs
+	lhc.peerCandidateMutex.Unlock()
+	return nil
+}
+
+func (lhc *LocalHeaderCache) getPeerRecord(host string, port uint16) (r *PeerRecord) {
+	r = new(PeerRecord)
+	value, err := lhc.db.getMeta(peerBookKey(host, port))
+	if err != nil || r.deserialize(peerBookKey(host, port), value) != nil {
+		return nil
+	}
+	return r
+}
+
+func (lhc *LocalHeaderCache) putPeerRecord(r *PeerRecord) error {
+	return lhc.db.putMeta(peerBookKey(r.Host, r.Port), r.serialize())
+}
+
+// peerRecord returns the book entry for a peer, creating it if needed
+func (lhc *LocalHeaderCache) peerRecord(host string, port uint16, source PeerSource) (r *PeerRecord) {
+	r = lhc.getPeerRecord(host, port)
+	if r == nil {
+		r = &PeerRecord{
+			Host:      host,
+			Port:      port,
+			Source:    source,
+			FirstSeen: uint32(time.Now().Unix()),
+		}
+	}
+	return r
+}
+
+func (lhc *LocalHeaderCache) peerSuccess(host string, port uint16, source PeerSource) {
+	lhc.peerBookMutex.Lock()
+	defer lhc.peerBookMutex.Unlock()
+	r := lhc.peerRecord(host, port, source)
+	r.LastSuccess = uint32(time.Now().Unix())
+	r.Failures = 0
+	lhc.putPeerRecord(r)
+}
+
+func (lhc *LocalHeaderCache) peerFailure(host string, port uint16, source PeerSource) {
+	lhc.peerBookMutex.Lock()
+	defer lhc.peerBookMutex.Unlock()
+	r := lhc.peerRecord(host, port, source)
+	r.LastFailure = uint32(time.Now().Unix())
+	r.Failures += 1
+	if r.expired(r.LastFailure) {
+		lhc.db.deleteMeta(peerBookKey(host, port))
+		return
+	}
+	lhc.putPeerRecord(r)
+}
+
+// KnownPeers returns the peer book
+func (lhc *LocalHeaderCache) KnownPeers() (peers []PeerRecord, err error) {
+	limit := append([]byte{}, peerBookPrefix...)
+	limit[len(limit)-1] += 1
+	iter := lhc.db.iter(peerBookPrefix, limit)
+	defer iter.Release()
+
+	peers = make([]PeerRecord, 0)
+	for iter.Next() {
+		var r PeerRecord
+		if r.deserialize(iter.Key(), iter.Value()) != nil {
+			continue
+		}
+		peers = append(peers, r)
+	}
+	return peers, iter.Error()
+}
+
+// bookCandidates returns peers from the book which are not connected and
+// are not backing off after failures, most recently successful first.
+// Peers which have been failing for too long, or which are beyond the size
+// limit of the book, are dropped from the book.
+func (lhc *LocalHeaderCache) bookCandidates() (candidates []*peerCandidate) {
+	peers, err := lhc.KnownPeers()
+	if err != nil {
+		return nil
+	}
+	now := uint32(time.Now().Unix())
+
+	sort.Sort(peerRecordSlice(peers))
+
+	kept := 0
+	candidates = make([]*peerCandidate, 0)
+	for _, r := range peers {
+		if r.expired(now) || (kept >= peerBookMaxSize) {
+			lhc.peerBookMutex.Lock()
+			lhc.db.deleteMeta(peerBookKey(r.Host, r.Port))
+			lhc.peerBookMutex.Unlock()
+			continue
+		}
+		kept += 1
+		if r.retryAfter() > now {
+			continue
+		}
+		if lhc.connected(r.Host, r.Port) {
+			continue
+		}
+		candidates = append(candidates, &peerCandidate{host: r.Host, port: r.Port, source: r.Source})
+	}
+	return candidates
+}
+
+// peerRecordSlice sorts peer records, most recently successful first and
+// then most recently seen
+type peerRecordSlice []PeerRecord
+
+func (z peerRecordSlice) Len() int {
+	return len(z)
+}
+
+func (z peerRecordSlice) Less(i, j int) bool {
+	if z[i].LastSuccess != z[j].LastSuccess {
+		return z[i].LastSuccess > z[j].LastSuccess
+	}
+	return z[i].FirstSeen > z[j].FirstSeen
+}
+
+func (z peerRecordSlice) Swap(i, j int) {
+	z[i], z[j] = z[j], z[i]
+}
+
+func (lhc *LocalHeaderCache) connected(host string, port uint16) bool {
+	for _, p := range lhc.Peers {
+		if (p.HC != nil) && (p.HC.host == host) && (p.HC.port == port) {
+			return true
+		}
+	}
+	return false
+}
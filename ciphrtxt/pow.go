@@ -0,0 +1,322 @@
+// Copyright (c) 2017, Joseph deBlaquiere <jadeblaquiere@yahoo.com>
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of ciphrtxt nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ciphrtxt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MessageHashTargetBits is the number of leading zero bits required in the
+// header hash for a message to be accepted by the network
+const MessageHashTargetBits = 16
+
+// MaxNonce is the size of the 40-bit nonce space
+const MaxNonce = (uint64(1) << 40)
+
+// the nonce only affects the last 8 characters of the base64 header, so the
+// hash state after all but the last 64 (one sha256 block) is reused
+const mineTailLength = 64
+
+const mineProgressInterval = 1 * time.Second
+const mineCountInterval = 4096
+
+// MineProgressFunc is called periodically from MineNonce with the total
+// number of hashes calculated so far
+type MineProgressFunc func(hashes uint64)
+
+// hashMeetsTarget returns true if the first bits of hash are zero
+func hashMeetsTarget(hash []byte, bits int) bool {
+	if bits > (8 * len(hash)) {
+		return false
+	}
+	for i := 0; bits > 0; i++ {
+		if bits >= 8 {
+			if hash[i] != 0 {
+				return false
+			}
+		} else {
+			if (hash[i] >> uint(8-bits)) != 0 {
+				return false
+			}
+		}
+		bits -= 8
+	}
+	return true
+}
+
+// MineNonce searches the 40-bit nonce space for a nonce such that the header
+// hash has (at least) bits leading zero bits. The search is split across
+// workers goroutines (runtime.NumCPU() if workers <= 0) and stops when a nonce
+// is found or ctx is cancelled. If progress is not nil it is called at
+// regular intervals from the calling goroutine. On success the nonce in h is
+// updated.
+func MineNonce(h *RawMessageHeader, bits int, workers int, ctx context.Context, progress MineProgressFunc) (err error) {
+	if (bits < 0) || (bits > 256) {
+		return fmt.Errorf("MineNonce: invalid target bits %d", bits)
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	if h.isV1() {
+		return errors.New("MineNonce: V1 headers have no nonce")
+	}
+	bmh := h.exportBinaryHeader()
+	if bmh == nil {
+		return errors.New("MineNonce: unable to export header")
+	}
+	b64 := []byte(base64.StdEncoding.EncodeToString(bmh))
+	midstateLength := len(b64) - mineTailLength
+	n := len(bmh)
+
+	mid := sha256.New()
+	mid.Write(b64[:midstateLength])
+	midstate, err := mid.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var hashes uint64
+	var wg sync.WaitGroup
+	found := make(chan uint64, workers)
+
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(start uint64) {
+			defer wg.Done()
+			hb := make([]byte, n)
+			copy(hb, bmh)
+			tail := make([]byte, mineTailLength)
+			d := sha256.New()
+			um := d.(encoding.BinaryUnmarshaler)
+			count := uint64(0)
+			for nonce := start; nonce < MaxNonce; nonce += uint64(workers) {
+				hb[n-5] = byte(nonce >> 32)
+				hb[n-4] = byte(nonce >> 24)
+				hb[n-3] = byte(nonce >> 16)
+				hb[n-2] = byte(nonce >> 8)
+				hb[n-1] = byte(nonce)
+				base64.StdEncoding.Encode(tail, hb[(midstateLength*3)/4:])
+				um.UnmarshalBinary(midstate)
+				d.Write(tail)
+				if hashMeetsTarget(d.Sum(nil), bits) {
+					found <- nonce
+					return
+				}
+				count += 1
+				if count == mineCountInterval {
+					atomic.AddUint64(&hashes, count)
+					count = 0
+					select {
+					case <-wctx.Done():
+						return
+					default:
+					}
+				}
+			}
+		}(uint64(w))
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(mineProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case nonce := <-found:
+			cancel()
+			<-done
+			h.nonce = nonce
+			return nil
+		case <-done:
+			select {
+			case nonce := <-found:
+				h.nonce = nonce
+				return nil
+			default:
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.New("MineNonce: nonce space exhausted")
+		case <-ticker.C:
+			if progress != nil {
+				progress(atomic.LoadUint64(&hashes))
+			}
+		}
+	}
+}
+
+// PoWPolicy determines the proof of work (number of leading zero bits in the
+// header hash) required for a message to be accepted, based on the message
+// size (in blocks) and lifetime (expire - time, in seconds).
+type PoWPolicy interface {
+	RequiredBits(blocklen uint32, lifetime uint32) int
+	Status() PoWPolicyStatus
+}
+
+// PoWPolicyStatus describes a PoWPolicy for peers (see StatusResponse)
+type PoWPolicyStatus struct {
+	Algorithm string `json:"algorithm"`
+	Policy    string `json:"policy"`
+	BaseBits  int    `json:"base_bits"`
+	BlockUnit uint32 `json:"block_unit,omitempty"`
+	TimeUnit  uint32 `json:"time_unit,omitempty"`
+	MaxBits   int    `json:"max_bits,omitempty"`
+}
+
+// FixedPoWPolicy requires the same number of bits for all messages
+type FixedPoWPolicy struct {
+	Bits int
+}
+
+func (p *FixedPoWPolicy) RequiredBits(blocklen uint32, lifetime uint32) int {
+	return p.Bits
+}
+
+func (p *FixedPoWPolicy) Status() PoWPolicyStatus {
+	return PoWPolicyStatus{
+		Algorithm: "sha256",
+		Policy:    "fixed",
+		BaseBits:  p.Bits,
+	}
+}
+
+// ScaledPoWPolicy requires BaseBits plus one additional bit for each doubling
+// of message size beyond BlockUnit blocks and one additional bit for each
+// doubling of message lifetime beyond TimeUnit seconds, up to MaxBits. A zero
+// unit disables scaling for that term and a zero MaxBits disables the limit.
+type ScaledPoWPolicy struct {
+	BaseBits  int
+	BlockUnit uint32
+	TimeUnit  uint32
+	MaxBits   int
+}
+
+func (p *ScaledPoWPolicy) RequiredBits(blocklen uint32, lifetime uint32) int {
+	nbits := p.BaseBits
+	if p.BlockUnit > 0 {
+		nbits += bits.Len32(blocklen / p.BlockUnit)
+	}
+	if p.TimeUnit > 0 {
+		nbits += bits.Len32(lifetime / p.TimeUnit)
+	}
+	if (p.MaxBits > 0) && (nbits > p.MaxBits) {
+		nbits = p.MaxBits
+	}
+	return nbits
+}
+
+func (p *ScaledPoWPolicy) Status() PoWPolicyStatus {
+	return PoWPolicyStatus{
+		Algorithm: "sha256",
+		Policy:    "scaled",
+		BaseBits:  p.BaseBits,
+		BlockUnit: p.BlockUnit,
+		TimeUnit:  p.TimeUnit,
+		MaxBits:   p.MaxBits,
+	}
+}
+
+// DefaultPoWPolicy is the network minimum, which is enforced by Ingest
+var DefaultPoWPolicy PoWPolicy = &FixedPoWPolicy{Bits: MessageHashTargetBits}
+
+// PoWPolicyFromStatus returns the policy a peer advertises in its status.
+// Peers which do not advertise a policy (or advertise one not known here, or
+// below the network minimum) are assumed to enforce DefaultPoWPolicy.
+func PoWPolicyFromStatus(s PoWPolicyStatus) PoWPolicy {
+	if (s.Algorithm != "sha256") || (s.BaseBits < MessageHashTargetBits) {
+		return DefaultPoWPolicy
+	}
+	switch s.Policy {
+	case "fixed":
+		return &FixedPoWPolicy{Bits: s.BaseBits}
+	case "scaled":
+		return &ScaledPoWPolicy{
+			BaseBits:  s.BaseBits,
+			BlockUnit: s.BlockUnit,
+			TimeUnit:  s.TimeUnit,
+			MaxBits:   s.MaxBits,
+		}
+	}
+	return DefaultPoWPolicy
+}
+
+// PoWError is returned when a message header hash does not meet the target
+// required by the policy in force
+type PoWError struct {
+	I        []byte
+	Required int
+}
+
+func (e *PoWError) Error() string {
+	return fmt.Sprintf("message %s header hash does not meet %d bit target", hex.EncodeToString(e.I), e.Required)
+}
+
+// RequiredBits returns the number of bits required by policy p for header h
+func RequiredBits(p PoWPolicy, h MessageHeader) int {
+	var lifetime uint32
+	t := h.MessageTime().Unix()
+	e := h.ExpireTime().Unix()
+	if e > t {
+		lifetime = uint32(e - t)
+	}
+	return p.RequiredBits(h.BlockLen(), lifetime)
+}
+
+// CheckPoW validates the header hash of h against policy p. V1 headers carry
+// no nonce and are not checked.
+func CheckPoW(p PoWPolicy, h MessageHeader) (err error) {
+	if h.isV1() {
+		return nil
+	}
+	nbits := RequiredBits(p, h)
+	if !hashMeetsTarget(h.Hash(), nbits) {
+		return &PoWError{I: h.IKey(), Required: nbits}
+	}
+	return nil
+}
@@ -41,13 +41,14 @@ import (
     "encoding/binary"
     //"encoding/hex"
     //"encoding/json"
-    //"fmt"
-    //"errors"
+    "fmt"
+    "errors"
     //"github.com/syndtr/goleveldb/leveldb"
     //"github.com/syndtr/goleveldb/leveldb/util"
     //"math/rand"
     //"os"
-    //"strconv"
+    "strconv"
+    "strings"
     //"sync"
     //"time"
 )
@@ -65,20 +66,247 @@ type ShardSector struct {
     Ring    uint `json:"ring"`
 }
 
-func (s *ShardSector) Contains(I []byte) (c bool) {
-    ringsz := ShardNBins >> s.Ring
-    end := s.Start + ringsz
-    
-    i := int(binary.BigEndian.Uint16(I[:2]))
+// ShardSectorSet is a set of bins described by non-overlapping sectors. Sets
+// returned by the sector operations are normalized: contiguous runs of bins
+// are described by as few sectors as possible, in order around the circle.
+type ShardSectorSet []ShardSector
+
+// shardBin maps i onto the circle of bins, so that bins past ShardMaxVal
+// wrap around to ShardBaseVal
+func shardBin(i int) int {
+    return (((i - ShardBaseVal) % ShardNBins + ShardNBins) % ShardNBins) + ShardBaseVal
+}
+
+// ParseShardSector parses the String form of a sector, the hex start bin and
+// the ring separated by a slash (e.g. "2a0/3")
+func ParseShardSector(str string) (s ShardSector, err error) {
+    parts := strings.Split(str, "/")
+    if len(parts) != 2 {
+        return s, fmt.Errorf("invalid shard sector %q", str)
+    }
+    start, err := strconv.ParseUint(parts[0], 16, 16)
+    if err != nil {
+        return s, fmt.Errorf("invalid shard sector start %q", parts[0])
+    }
+    ring, err := strconv.ParseUint(parts[1], 10, 8)
+    if err != nil {
+        return s, fmt.Errorf("invalid shard sector ring %q", parts[1])
+    }
+    s = ShardSector{Start: int(start), Ring: uint(ring)}
+    if !s.Valid() {
+        return s, fmt.Errorf("shard sector %q out of range", str)
+    }
+    return s, nil
+}
+
+// Valid reports whether the start bin and ring are in range
+func (s ShardSector) Valid() bool {
+    return (s.Start >= ShardBaseVal) && (s.Start < ShardMaxVal) && (s.Ring <= ShardSectorOuterRing)
+}
+
+func (s ShardSector) String() string {
+    return fmt.Sprintf("%03x/%d", s.Start, s.Ring)
+}
+
+// Size is the number of bins in the sector
+func (s ShardSector) Size() int {
+    if s.Ring > ShardSectorOuterRing {
+        return 0
+    }
+    return ShardNBins >> s.Ring
+}
+
+// Bins lists the bins in the sector, from Start around the circle
+func (s ShardSector) Bins() (bins []int) {
+    bins = make([]int, s.Size())
+    for i := range bins {
+        bins[i] = shardBin(s.Start + i)
+    }
+    return bins
+}
+
+// spans returns the sector as one or two (if it wraps around) ranges of bins
+// [begin, end) within ShardBaseVal .. ShardMaxVal
+func (s ShardSector) spans() (spans [][2]int) {
+    end := s.Start + s.Size()
     if end > ShardMaxVal {
-        if (i < s.Start) && (i >= (end - ShardNBins)) {
-            return false
+        return [][2]int{{s.Start, ShardMaxVal}, {ShardBaseVal, end - ShardNBins}}
+    }
+    return [][2]int{{s.Start, end}}
+}
+
+func (s ShardSector) containsBin(bin int) bool {
+    return shardBin(bin - s.Start) - ShardBaseVal < s.Size()
+}
+
+func (s ShardSector) Contains(I []byte) (c bool) {
+    return s.containsBin(int(binary.BigEndian.Uint16(I[:2])))
+}
+
+// Split divides the sector into its two halves in the next ring out. Sectors
+// in the outer ring cannot be split and are returned whole.
+func (s ShardSector) Split() []ShardSector {
+    if s.Ring >= ShardSectorOuterRing {
+        return []ShardSector{s}
+    }
+    half := ShardSector{Start: s.Start, Ring: s.Ring + 1}
+    return []ShardSector{half, {Start: shardBin(s.Start + half.Size()), Ring: s.Ring + 1}}
+}
+
+func (s ShardSector) Overlaps(o ShardSector) bool {
+    for _, bin := range s.Bins() {
+        if o.containsBin(bin) {
+            return true
+        }
+    }
+    return false
+}
+
+// Intersect returns the bins in both sectors. Sectors may overlap at both
+// ends, so the intersection is not always contiguous.
+func (s ShardSector) Intersect(o ShardSector) ShardSectorSet {
+    return ShardSectorSet{s}.Intersect(ShardSectorSet{o})
+}
+
+// Union returns the bins in either sector
+func (s ShardSector) Union(o ShardSector) ShardSectorSet {
+    return ShardSectorSet{s}.Union(ShardSectorSet{o})
+}
+
+// shardBinMap marks the bins of a set, indexed from ShardBaseVal
+type shardBinMap [ShardNBins]bool
+
+func (ss ShardSectorSet) binMap() (m *shardBinMap) {
+    m = new(shardBinMap)
+    for _, s := range ss {
+        for _, bin := range s.Bins() {
+            m[bin - ShardBaseVal] = true
         }
-    } else {
-        if (i < s.Start) || (i >= end) {
-            return false
+    }
+    return m
+}
+
+// sectors describes the marked bins with the fewest sectors. Each run of
+// bins is split into sectors from the largest size down, as sector sizes
+// are powers of 2.
+func (m *shardBinMap) sectors() (ss ShardSectorSet) {
+    ss = make(ShardSectorSet, 0)
+    first := -1
+    for i := 0; i < ShardNBins; i++ {
+        if !m[i] {
+            first = i
+            break
+        }
+    }
+    if first < 0 {
+        return append(ss, ShardSector{Start: ShardBaseVal, Ring: 0})
+    }
+    // runs begin after an unmarked bin, so start from one to avoid
+    // splitting a run which wraps around
+    for i := 1; i <= ShardNBins; i++ {
+        bin := (first + i) % ShardNBins
+        if !m[bin] {
+            continue
+        }
+        run := 0
+        for m[(bin + run) % ShardNBins] {
+            run += 1
+        }
+        i += run - 1
+        for run > 0 {
+            ring := uint(0)
+            for (ShardNBins >> ring) > run {
+                ring += 1
+            }
+            ss = append(ss, ShardSector{Start: bin + ShardBaseVal, Ring: ring})
+            bin = (bin + (ShardNBins >> ring)) % ShardNBins
+            run -= ShardNBins >> ring
+        }
+    }
+    return ss
+}
+
+func (ss ShardSectorSet) Size() (size int) {
+    m := ss.binMap()
+    for _, b := range m {
+        if b {
+            size += 1
+        }
+    }
+    return size
+}
+
+// Bins lists the bins in the set in ascending order
+func (ss ShardSectorSet) Bins() (bins []int) {
+    m := ss.binMap()
+    bins = make([]int, 0)
+    for i, b := range m {
+        if b {
+            bins = append(bins, i + ShardBaseVal)
+        }
+    }
+    return bins
+}
+
+func (ss ShardSectorSet) Contains(I []byte) bool {
+    for _, s := range ss {
+        if s.Contains(I) {
+            return true
         }
     }
-    return true
+    return false
+}
+
+func (ss ShardSectorSet) Overlaps(o ShardSectorSet) bool {
+    return len(ss.Intersect(o)) > 0
+}
+
+func (ss ShardSectorSet) Union(o ShardSectorSet) ShardSectorSet {
+    m := ss.binMap()
+    for i, b := range o.binMap() {
+        m[i] = m[i] || b
+    }
+    return m.sectors()
 }
 
+func (ss ShardSectorSet) Intersect(o ShardSectorSet) ShardSectorSet {
+    m := ss.binMap()
+    for i, b := range o.binMap() {
+        m[i] = m[i] && b
+    }
+    return m.sectors()
+}
+
+// Subtract returns the bins in ss which are not in o
+func (ss ShardSectorSet) Subtract(o ShardSectorSet) ShardSectorSet {
+    m := ss.binMap()
+    for i, b := range o.binMap() {
+        m[i] = m[i] && !b
+    }
+    return m.sectors()
+}
+
+// String lists the sectors separated by commas (e.g. "200/2,3a0/4")
+func (ss ShardSectorSet) String() string {
+    strs := make([]string, len(ss))
+    for i, s := range ss {
+        strs[i] = s.String()
+    }
+    return strings.Join(strs, ",")
+}
+
+// ParseShardSectorSet parses the String form of a sector set
+func ParseShardSectorSet(str string) (ss ShardSectorSet, err error) {
+    if len(str) == 0 {
+        return nil, errors.New("empty shard sector set")
+    }
+    ss = make(ShardSectorSet, 0)
+    for _, p := range strings.Split(str, ",") {
+        s, err := ParseShardSector(strings.TrimSpace(p))
+        if err != nil {
+            return nil, err
+        }
+        ss = append(ss, s)
+    }
+    return ss.binMap().sectors(), nil
+}
@@ -178,7 +178,7 @@ func (wsm *WSMessage) DumpMessageHeader() (rmh *RawMessageHeader) {
 		return nil
 	}
 	hdr := new(RawMessageHeader)
-	err := hdr.ImportBytes(wsm.Data[:])
+	err := hdr.ImportBytesStrict(wsm.Data[:])
 	if err != nil {
 		return nil
 	}
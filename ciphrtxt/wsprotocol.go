@@ -209,7 +209,7 @@ func (wsh *wsHandler) TxHeader(rmh MessageHeader) {
 
 func (wsh *wsHandler) rxHeader(s string) {
 	rmh := &RawMessageHeader{}
-	err := rmh.Deserialize(s)
+	err := rmh.DeserializeStrict(s)
 	if err == nil {
 		wsh.resetWatchdog()
 		wsh.log("rx<-HEADER from")
@@ -33,12 +33,13 @@ import (
 	//"log"
 	//"net/http"
 	//"crypto/elliptic"
-	"crypto/rand"
+	//"crypto/rand"
 	"encoding/hex"
-	"io"
-	"math/big"
+	//"io"
+	"math"
+	//"math/big"
 	"net/http"
-	"os"
+	//"os"
 	"runtime"
 	"sort"
 	"strconv"
@@ -69,6 +70,28 @@ var configExternalHost = flag.String("exthost", "", "Message Service advertised
 var configExternalPort = flag.Int("extport", 8080, "Message Service advertised port number")
 var configListenPort = flag.Int("listenport", 8080, "Message Service listen port number")
 var configTargetRing = flag.Int("ring", 2, "Target value for ring, default=2")
+var configContract = flag.Bool("contract", false, "Evict messages outside the target sectors (after -contractgrace) when the targets shrink")
+var configContractGrace = flag.Int("contractgrace", 3600, "Time to keep messages outside shrunken targets so that peers can fetch them, in seconds")
+var configAutoSize = flag.Bool("autosize", false, "Adjust the target ring to fit -quota and the start bin to cover bins least replicated by peers")
+var configAutoSizeInterval = flag.Int("autosizeinterval", 600, "Interval between automatic sizing checks, in seconds")
+var configNodeKey = flag.String("nodekey", "./nodekey", "Node private key file, created if missing. The node public key determines the start bin")
+var configSectors = flag.String("sectors", "", "Comma separated sectors (start/ring, e.g. 2a0/3) to store, instead of the node key start bin at -ring")
+var configPoWPolicy = flag.String("powpolicy", "fixed", "Proof of work policy (fixed, scaled)")
+var configPoWBits = flag.Int("powbits", ciphrtxt.MessageHashTargetBits, "Proof of work (base) target, in leading zero bits")
+var configPoWBlockUnit = flag.Int("powblockunit", 64, "Scaled PoW: add 1 bit per doubling of message size beyond this many blocks")
+var configPoWTimeUnit = flag.Int("powtimeunit", (8 * 24 * 3600), "Scaled PoW: add 1 bit per doubling of message lifetime beyond this many seconds")
+var configPoWMaxBits = flag.Int("powmaxbits", 32, "Scaled PoW: maximum target, in leading zero bits (0 = no limit)")
+var configPeerStorage = flag.String("peerstorage", "disk", "Storage for peer header caches (disk, inbound = in-memory for inbound peers, memory)")
+var configRecipientIndex = flag.Bool("recipientindex", false, "Maintain J/K recipient indexes for header queries")
+var configQuota = flag.Int("quota", 256, "Message store capacity, in GiB")
+var configMaxFileSize = flag.Int("maxfilesize", ciphrtxt.MaxMessageFileSize, "Maximum message file size, in bytes")
+var configEviction = flag.String("eviction", "outside", "Eviction policy when the store nears capacity (outside, expiring, largest)")
+var configFsck = flag.String("fsck", "", "Check (check) or repair (repair) the message store and exit")
+var configRescan = flag.Bool("rescan", false, "Scan the message store for unindexed messages on startup, even after a clean shutdown")
+var configSeeds = flag.String("seeds", "", "Comma separated seed peers (host:port), used when no known peer can be reached (default built-in seeds, none = no seeds)")
+var configPeers = flag.String("peers", "", "Comma separated peers (host:port) to connect to on startup")
+var configRequireSig = flag.Bool("requiresig", false, "Reject messages whose header signature does not verify")
+var configScrubInterval = flag.Int("scrubinterval", (6 * 3600), "Interval between message store integrity scrubs, in seconds (0 = disabled)")
 
 var banner string = `       _       _          _        _   
       (_)     | |        | |      | |  
@@ -79,6 +102,48 @@ var banner string = `       _       _          _        _
         | |                            
         |_|                            `
 
+func configPoWPolicyFromFlags() (p ciphrtxt.PoWPolicy, err error) {
+	if *configPoWBits < ciphrtxt.MessageHashTargetBits {
+		return nil, fmt.Errorf("powbits must be at least %d", ciphrtxt.MessageHashTargetBits)
+	}
+	switch *configPoWPolicy {
+	case "fixed":
+		return &ciphrtxt.FixedPoWPolicy{Bits: *configPoWBits}, nil
+	case "scaled":
+		return &ciphrtxt.ScaledPoWPolicy{
+			BaseBits:  *configPoWBits,
+			BlockUnit: uint32(*configPoWBlockUnit),
+			TimeUnit:  uint32(*configPoWTimeUnit),
+			MaxBits:   *configPoWMaxBits,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown PoW policy \"%s\"", *configPoWPolicy)
+}
+
+func configEvictionPolicyFromFlags() (p ciphrtxt.EvictionPolicy, err error) {
+	switch *configEviction {
+	case "outside":
+		return &ciphrtxt.OutsideTargetEviction{}, nil
+	case "expiring":
+		return &ciphrtxt.SoonestExpiringEviction{}, nil
+	case "largest":
+		return &ciphrtxt.LargestEviction{}, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy \"%s\"", *configEviction)
+}
+
+func configPeerStorageFromFlags() (ciphrtxt.PeerStorage, error) {
+	switch *configPeerStorage {
+	case "disk":
+		return ciphrtxt.PeerStorageDisk, nil
+	case "inbound":
+		return ciphrtxt.PeerStorageInboundMemory, nil
+	case "memory":
+		return ciphrtxt.PeerStorageMemory, nil
+	}
+	return ciphrtxt.PeerStorageDisk, fmt.Errorf("unknown peer storage \"%s\"", *configPeerStorage)
+}
+
 func main() {
 	nCpu := runtime.NumCPU()
 	nCpuOrig := runtime.GOMAXPROCS(nCpu)
@@ -87,17 +152,34 @@ func main() {
 
 	flag.Parse()
 
-	curve := btcec.S256()
-	p := curve.Params().P
+	var err error
+	privKey, err = ciphrtxt.LoadOrCreateNodeKey(*configNodeKey)
+	if err != nil {
+		fmt.Println("whoops:", err)
+		return
+	}
+	pubKey = privKey.PubKey()
 
-	//fmt.Printf("p = %s\n", p.Text(16))
+	//fmt.Printf("privkey = %s\n", hex.EncodeToString(privKey.Serialize()))
+	fmt.Printf("Node Pubkey  = %s\n", hex.EncodeToString(pubKey.SerializeCompressed()))
+
+	powPolicy, err := configPoWPolicyFromFlags()
+	if err != nil {
+		fmt.Println("whoops:", err)
+		return
+	}
 
-	privKeyInt, _ := rand.Int(rand.Reader, p)
-	privKey, pubKey = btcec.PrivKeyFromBytes(curve, privKeyInt.Bytes())
+	peerStorage, err := configPeerStorageFromFlags()
+	if err != nil {
+		fmt.Println("whoops:", err)
+		return
+	}
 
-	//fmt.Printf("privkey = %s\n", privKeyInt.Text(16))
-	//fmt.Printf("privkey = %s\n", hex.EncodeToString(privKey.Serialize()))
-	fmt.Printf("Ephemeral Pubkey  = %s\n", hex.EncodeToString(pubKey.SerializeCompressed()))
+	evictionPolicy, err := configEvictionPolicyFromFlags()
+	if err != nil {
+		fmt.Println("whoops:", err)
+		return
+	}
 
 	lhc, err := ciphrtxt.OpenLocalHeaderCache("headers")
 	if err != nil {
@@ -106,17 +188,88 @@ func main() {
 	}
 	defer lhc.Close()
 
+	lhc.SetPoWPolicy(powPolicy)
+	lhc.SetPeerStorage(peerStorage)
+
+	// check or repair the store as found, before any recovery or network
+	// activity
+	if *configFsck != "" {
+		if (*configFsck != "check") && (*configFsck != "repair") {
+			fmt.Printf("whoops: unknown fsck mode \"%s\"\n", *configFsck)
+			return
+		}
+		fms, err := ciphrtxt.OpenMessageStoreFsck("./messages", lhc)
+		if err != nil {
+			fmt.Println("whoops:", err)
+			return
+		}
+		defer fms.Close()
+		fms.SetQuota(int64(*configQuota)*1024*1024*1024, int64(*configMaxFileSize))
+		fms.SetRequireSignatures(*configRequireSig)
+		report, err := fms.Fsck(*configFsck == "repair")
+		if err != nil {
+			fmt.Println("whoops:", err)
+			return
+		}
+		fmt.Println(report)
+		return
+	}
+
+	if *configSeeds != "" {
+		seeds := []string{}
+		if *configSeeds != "none" {
+			seeds = strings.Split(*configSeeds, ",")
+		}
+		err = lhc.SetSeedPeers(seeds)
+		if err != nil {
+			fmt.Println("whoops:", err)
+			return
+		}
+	}
+
+	if *configPeers != "" {
+		for _, peer := range strings.Split(*configPeers, ",") {
+			host, port, err := ciphrtxt.ParsePeerAddress(peer)
+			if err != nil {
+				fmt.Println("whoops:", err)
+				return
+			}
+			lhc.AddPeerWithSource(host, port, ciphrtxt.PeerSourceManual)
+		}
+	}
+
+	if *configRecipientIndex {
+		err = lhc.EnableRecipientIndex()
+		if err != nil {
+			fmt.Println("whoops:", err)
+			return
+		}
+	}
+
 	lhc.ExternalHost = *configExternalHost
 	lhc.ExternalPort = *configExternalPort
 	lhc.ExtTokenPort = *configExtTokenPort
 
 	lhc.Sync()
 
-	startbig, _ := rand.Int(rand.Reader, big.NewInt(0x200))
-	startbin := int(startbig.Int64()) + 0x200
-	target := ciphrtxt.ShardSector{
+	// the start bin follows from the node key, so restarts resume the same
+	// sector
+	startbin := ciphrtxt.NodeStartBin(pubKey)
+	targets := ciphrtxt.ShardSectorSet{{
 		Start: startbin,
 		Ring:  uint(*configTargetRing),
+	}}
+	if *configSectors != "" {
+		if *configAutoSize {
+			fmt.Println("whoops: -sectors and -autosize are exclusive")
+			return
+		}
+		targets, err = ciphrtxt.ParseShardSectorSet(*configSectors)
+		if err != nil {
+			fmt.Println("whoops:", err)
+			return
+		}
+		startbin = targets[0].Start
 	}
 
 	ms, err = ciphrtxt.OpenMessageStore("./messages", lhc, startbin)
@@ -126,7 +279,37 @@ func main() {
 	}
 	defer ms.Close()
 
-	ms.SetTarget(target)
+	if *configRecipientIndex {
+		err = ms.EnableRecipientIndex()
+		if err != nil {
+			fmt.Println("whoops:", err)
+			return
+		}
+	}
+
+	// automatic sizing may have moved the target, resume where it left off
+	if *configAutoSize {
+		if stored := ms.StoredTargets(); len(stored) > 0 {
+			targets = stored
+		}
+	}
+
+	ms.SetQuota(int64(*configQuota)*1024*1024*1024, int64(*configMaxFileSize))
+	ms.SetEvictionPolicy(evictionPolicy)
+	ms.SetRequireSignatures(*configRequireSig)
+
+	if *configRescan {
+		_, err = ms.Rescan()
+		if err != nil {
+			fmt.Println("whoops:", err)
+			return
+		}
+	}
+
+	if *configContract {
+		ms.SetContraction(time.Duration(*configContractGrace)*time.Second, ciphrtxt.DefaultContractionRate)
+	}
+	ms.SetTargets(targets)
 	ms.ExternalHost = *configExternalHost
 	ms.ExternalPort = *configExternalPort
 	ms.ExtTokenPort = *configExtTokenPort
@@ -153,6 +336,30 @@ func main() {
 		}
 	}(ms, 60)
 
+	if *configScrubInterval > 0 {
+		go func(ms *ciphrtxt.MessageStore, interval int) {
+			for {
+				time.Sleep(time.Second * time.Duration(interval))
+				_, err := ms.Scrub()
+				if err != nil {
+					fmt.Printf("Scrub failed: %s\n", err)
+				}
+			}
+		}(ms, *configScrubInterval)
+	}
+
+	if *configAutoSize {
+		go func(ms *ciphrtxt.MessageStore, interval int) {
+			for {
+				time.Sleep(time.Second * time.Duration(interval))
+				_, err := ms.AutoSize()
+				if err != nil {
+					fmt.Printf("AutoSize failed: %s\n", err)
+				}
+			}
+		}(ms, *configAutoSizeInterval)
+	}
+
 	//ms.LHC.DiscoverPeers(*configExternalHost, uint16(*configExternalPort))
 
 	api := iris.New()
@@ -200,8 +407,9 @@ func main() {
 }
 
 func index(ctx context.Context) {
+	// messages sent in the last hour (or later, from clients with fast clocks)
 	now := uint32(time.Now().Unix())
-	lastHr, err := ms.FindSince(now - 3600)
+	lastHr, err := ms.FindByTimeRange(now-3600, math.MaxUint32)
 	sort.Sort(sort.Reverse(ciphrtxt.MessageFileSlice(lastHr)))
 	if err != nil {
 		ctx.StatusCode(500)
@@ -229,10 +437,11 @@ func peers(ctx context.Context) {
 	pi.Port = uint16(*configExternalPort)
 	pi.URL = "/index.html"
 	pi.Headers = lhc.Count
-	pi.Messages = ms.Count
+	pi.Messages = ms.Count()
 	target := ms.GetCurrentTarget()
 	pi.Start = target.Start
 	pi.Ring = int(target.Ring)
+	pi.Sectors = ms.GetCurrentTargets().String()
 	peerInfo = append(peerInfo, *pi)
 	for _, p := range lhc.Peers {
 		pi := p.HC.GetPeerStatsJSON()
@@ -255,20 +464,111 @@ func get_headers(ctx context.Context) {
 	//    fmt.Printf("GetHeaders: since = %d\n", since)
 	//}
 
+	// J or K (hex prefix of the point) select headers by recipient
+	Jhex := ctx.URLParam("J")
+	Khex := ctx.URLParam("K")
+
 	lhc := ms.LHC
-	hdrs, err := lhc.FindSince(uint32(since))
-	if err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
+	if (Jhex != "") || (Khex != "") {
+		find := lhc.FindByJ
+		if Jhex == "" {
+			find = lhc.FindByK
+			Jhex = Khex
+		}
+		prefix, err := hex.DecodeString(Jhex)
+		if err != nil {
+			ctx.StatusCode(iris.StatusBadRequest)
+			return
+		}
+		hdrs, err := find(prefix)
+		if err == ciphrtxt.ErrRecipientIndexDisabled {
+			ctx.StatusCode(iris.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			ctx.StatusCode(iris.StatusInternalServerError)
+			return
+		}
+		res := make([]string, len(hdrs))
+
+		for i, h := range hdrs {
+			res[i] = h.Serialize()
+		}
+
+		ctx.StatusCode(iris.StatusOK)
+		ctx.JSON(ciphrtxt.HeaderListResponse{Headers: res})
 		return
 	}
-	res := make([]string, len(hdrs))
 
-	for i, h := range hdrs {
-		res[i] = h.Serialize()
+	limit, cursor, ok := listParams(ctx)
+	if !ok {
+		ctx.StatusCode(iris.StatusBadRequest)
+		return
+	}
+	var it ciphrtxt.HeaderIterator
+	if (ctx.URLParam("from") != "") || (ctx.URLParam("to") != "") {
+		// from and to select by message time rather than servertime
+		from, to, ok := timeRangeParams(ctx)
+		if !ok {
+			ctx.StatusCode(iris.StatusBadRequest)
+			return
+		}
+		if cursor != nil {
+			it = lhc.IterTimeRangeCursor(cursor, to, limit)
+		} else {
+			it = lhc.IterTimeRange(from, to, limit)
+		}
+	} else if cursor != nil {
+		it = lhc.IterCursor(cursor, limit)
+	} else {
+		it = lhc.IterSince(uint32(since), limit)
 	}
 
+	ctx.ContentType("application/json")
 	ctx.StatusCode(iris.StatusOK)
-	ctx.JSON(ciphrtxt.HeaderListResponse{Headers: res})
+	err = ciphrtxt.WriteHeaderList(ctx, it, limit)
+	if err != nil {
+		fmt.Printf("GetHeaders: %s\n", err)
+	}
+}
+
+// listParams parses the limit and cursor parameters of the list requests
+func listParams(ctx context.Context) (limit int, cursor ciphrtxt.HeaderCursor, ok bool) {
+	limit, err := ctx.URLParamInt("limit")
+	if err != nil {
+		limit = 0
+	}
+	if limit < 0 {
+		return 0, nil, false
+	}
+	if c := ctx.URLParam("cursor"); c != "" {
+		cursor, err = ciphrtxt.ParseHeaderCursor(c)
+		if err != nil {
+			return 0, nil, false
+		}
+	}
+	return limit, cursor, true
+}
+
+// timeRangeParams parses the from and to parameters, which default to the
+// start and end of time
+func timeRangeParams(ctx context.Context) (from uint32, to uint32, ok bool) {
+	from, to = 0, math.MaxUint32
+	if f := ctx.URLParam("from"); f != "" {
+		v, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+		from = uint32(v)
+	}
+	if t := ctx.URLParam("to"); t != "" {
+		v, err := strconv.ParseUint(t, 10, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+		to = uint32(v)
+	}
+	return from, to, true
 }
 
 func get_header_info(ctx context.Context) {
@@ -312,19 +612,24 @@ func get_messages(ctx context.Context) {
 	//    fmt.Printf("since = %d\n", since)
 	//}
 
-	msgs, err := ms.FindSince(uint32(since))
-	if err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
+	limit, cursor, ok := listParams(ctx)
+	if !ok {
+		ctx.StatusCode(iris.StatusBadRequest)
 		return
 	}
-	res := make([]string, len(msgs))
-
-	for i, m := range msgs {
-		res[i] = hex.EncodeToString(m.IKey())
+	var it ciphrtxt.MessageIterator
+	if cursor != nil {
+		it = ms.IterCursor(cursor, limit)
+	} else {
+		it = ms.IterSince(uint32(since), limit)
 	}
 
+	ctx.ContentType("application/json")
 	ctx.StatusCode(iris.StatusOK)
-	ctx.JSON(ciphrtxt.MessageListResponse{Messages: res})
+	err = ciphrtxt.WriteMessageList(ctx, it, limit)
+	if err != nil {
+		fmt.Printf("GetMessages: %s\n", err)
+	}
 }
 
 func get_peers(ctx context.Context) {
@@ -376,6 +681,11 @@ func download_message(ctx context.Context) {
 			ctx.StatusCode(iris.StatusNotFound)
 			return
 		}
+		err = ms.CheckMessage(m)
+		if err != nil {
+			ctx.StatusCode(iris.StatusNotFound)
+			return
+		}
 	} else {
 		m, err = ms.FindOrFetchByI(I)
 		if err != nil {
@@ -400,39 +710,23 @@ func upload_message(ctx context.Context) {
 	}
 	defer src.Close()
 
-	recvpath := "./messages/receive/" + strconv.Itoa(int(time.Now().UnixNano()))
-	dst, err := os.Create(recvpath)
+	m, err := ciphrtxt.IngestReader(src, ms.PoWPolicy(), ms.MaxFileSize(), "./messages/receive")
 	if err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
-		return
-	}
-
-	if _, err = io.Copy(dst, src); err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
-		dst.Close()
-		return
-	}
-
-	dst.Close()
-
-	m := ciphrtxt.Ingest(recvpath)
-	if m == nil {
-		ctx.StatusCode(iris.StatusBadRequest)
-		return
-	}
-
-	Ihex := hex.EncodeToString(m.IKey())
-	filemove := "./messages/store/" + Ihex[:4] + "/" + Ihex
-	//fmt.Printf("moving to %s\n", filemove)
-	err = m.Move(filemove)
-	if err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
+		if err == ciphrtxt.ErrMessageTooLarge {
+			ctx.StatusCode(iris.StatusRequestEntityTooLarge)
+		} else {
+			ctx.StatusCode(iris.StatusBadRequest)
+		}
 		return
 	}
 
-	servertime, err := ms.InsertFile(filemove)
+	servertime, err := ms.Store(m)
 	if err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
+		if err == ciphrtxt.ErrStoreFull {
+			ctx.StatusCode(iris.StatusInsufficientStorage)
+		} else {
+			ctx.StatusCode(iris.StatusInternalServerError)
+		}
 		return
 	}
 